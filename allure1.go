@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Структуры отчета Allure 1 (*-testsuite.xml)
+type (
+	Allure1TestSuite struct {
+		Version   string            `xml:"version,attr"`
+		Name      string            `xml:"name"`
+		Title     string            `xml:"title"`
+		Labels    []Allure1Label    `xml:"labels>label"`
+		TestCases []Allure1TestCase `xml:"test-cases>test-case"`
+	}
+
+	Allure1TestCase struct {
+		Name   string         `xml:"name"`
+		Title  string         `xml:"title"`
+		Status string         `xml:"status,attr"`
+		Start  int64          `xml:"start,attr"`
+		Stop   int64          `xml:"stop,attr"`
+		Labels []Allure1Label `xml:"labels>label"`
+		Steps  []Allure1Step  `xml:"steps>step"`
+
+		Attachments []Allure1Attachment `xml:"attachments>attachment"`
+
+		Failure struct {
+			Message string `xml:"message"`
+		} `xml:"failure"`
+	}
+
+	Allure1Step struct {
+		Name        string              `xml:"name"`
+		Title       string              `xml:"title"`
+		Status      string              `xml:"status,attr"`
+		Start       int64               `xml:"start,attr"`
+		Stop        int64               `xml:"stop,attr"`
+		Attachments []Allure1Attachment `xml:"attachments>attachment"`
+		Steps       []Allure1Step       `xml:"steps>step"`
+	}
+
+	Allure1Attachment struct {
+		Title  string `xml:"title,attr"`
+		Source string `xml:"source,attr"`
+		Type   string `xml:"type,attr"`
+		Size   int64  `xml:"size,attr"`
+	}
+
+	Allure1Label struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	}
+
+	Allure1Environment struct {
+		Parameters []struct {
+			Key   string `xml:"key"`
+			Value string `xml:"value"`
+		} `xml:"parameter"`
+	}
+)
+
+// Читает результаты Allure 1 в тот же снимок, что строится по отчету Allure 2.
+// В Allure 1 нет summary, executor и истории: summary считается по тест-кейсам
+func parseAllure1Report(src *reportSource, snap *ReportSnapshot) error {
+	source := src.fsys
+
+	// 1. Парсинг environment
+	if env, err := parseAllure1Environment(source, "environment.xml"); err == nil {
+		snap.Environment = env
+		snap.EnvHash = hashEnvironment(env)
+		snap.stage("environment", nil)
+	} else {
+		logger.Warn("Environment parse failed", zap.Error(err))
+		snap.stage("environment", err)
+	}
+
+	// 2. Парсинг тест-сьютов
+	suiteFiles, err := fs.Glob(source, "*-testsuite.xml")
+	if err == nil && len(suiteFiles) == 0 {
+		err = fmt.Errorf("no *-testsuite.xml files found")
+	}
+	// Summary в Allure 1 считается по тест-сьютам, поэтому они обязательная стадия
+	snap.stage("summary", err)
+	if err != nil {
+		return fmt.Errorf("test suites: %w", err)
+	}
+
+	var summary summaryCounter
+	for _, suiteFile := range suiteFiles {
+		if info, err := fs.Stat(source, suiteFile); err == nil && info.ModTime().After(snap.NewestModTime) {
+			snap.NewestModTime = info.ModTime()
+		}
+
+		fileStart := time.Now()
+		suite, err := parseAllure1Suite(source, suiteFile)
+		if cfg.profileParse {
+			exporterMetrics.testcaseParse.Observe(time.Since(fileStart).Seconds())
+		}
+		if err != nil {
+			logger.Warn("Test suite parse failed",
+				zap.String("file", suiteFile),
+				zap.Error(err))
+			snap.ParseErrors++
+			continue
+		}
+
+		// Версия адаптера Allure 1 записана в корне тест-сьюта
+		if snap.FormatVersion == "" && suite.Version != "" {
+			snap.FormatVersion = suite.Version
+		}
+
+		// Отдельных файлов тест-кейсов в Allure 1 нет, поэтому считаются сами тест-кейсы
+		snap.TestCaseFiles += len(suite.TestCases)
+		for i := range suite.TestCases {
+			tc := suite.TestCases[i].testCase(suite)
+			summary.add(tc)
+			snap.addTestCase(tc, suiteFile)
+		}
+	}
+	snap.Summary = summary.result()
+
+	if snap.FormatVersion == "" {
+		snap.FormatVersion = "1"
+	}
+
+	return nil
+}
+
+// Summary по тест-кейсам для источников без widgets/summary.json;
+// учитываются все тесты, включая отфильтрованные по сьюту
+func summarize(testCases []*AllureTestCase) *AllureSummary {
+	var summary summaryCounter
+	for _, tc := range testCases {
+		summary.add(tc)
+	}
+	return summary.result()
+}
+
+// Summary, который набирается по одному тест-кейсу без списка всех тестов
+type summaryCounter struct {
+	summary     AllureSummary
+	first, last int64
+}
+
+func (c *summaryCounter) add(tc *AllureTestCase) {
+	if tc == nil {
+		return
+	}
+
+	switch tc.Status {
+	case "passed":
+		c.summary.Statistic.Passed++
+	case "failed":
+		c.summary.Statistic.Failed++
+	case "broken":
+		c.summary.Statistic.Broken++
+	case "skipped":
+		c.summary.Statistic.Skipped++
+	}
+	if tc.Start > 0 && (c.first == 0 || tc.Start < c.first) {
+		c.first = tc.Start
+	}
+	if tc.Stop > c.last {
+		c.last = tc.Stop
+	}
+}
+
+func (c *summaryCounter) result() *AllureSummary {
+	summary := c.summary
+	if c.first > 0 && c.last > c.first {
+		summary.Time.Duration = c.last - c.first
+	}
+	return &summary
+}
+
+func parseAllure1Suite(source fs.FS, name string) (*Allure1TestSuite, error) {
+	data, err := readReportFile(source, name)
+	if err != nil {
+		return nil, readError(name, err)
+	}
+
+	var suite Allure1TestSuite
+	if err := xml.Unmarshal(data, &suite); err != nil {
+		return nil, fmt.Errorf("xml unmarshal: %w", err)
+	}
+
+	return &suite, nil
+}
+
+func parseAllure1Environment(source fs.FS, name string) (AllureEnvironment, error) {
+	data, err := readReportFile(source, name)
+	if err != nil {
+		return nil, readError(name, err)
+	}
+
+	var raw Allure1Environment
+	if err := xml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("xml unmarshal: %w", err)
+	}
+
+	env := make(AllureEnvironment, len(raw.Parameters))
+	for _, p := range raw.Parameters {
+		env[p.Key] = p.Value
+	}
+	return env, nil
+}
+
+// Приводит тест-кейс Allure 1 к модели Allure 2
+func (c *Allure1TestCase) testCase(suite *Allure1TestSuite) *AllureTestCase {
+	tc := &AllureTestCase{
+		Name:   allure1Title(c.Title, c.Name),
+		Status: allure1Status(c.Status),
+		Start:  c.Start,
+		Stop:   c.Stop,
+
+		StatusDetails: StatusDetails{Message: c.Failure.Message},
+	}
+
+	for _, label := range c.Labels {
+		tc.Labels = append(tc.Labels, Label{Name: label.Name, Value: label.Value})
+	}
+	// Метки сьюта относятся ко всем его тест-кейсам
+	for _, label := range suite.Labels {
+		if !hasLabel(tc.Labels, label.Name) {
+			tc.Labels = append(tc.Labels, Label{Name: label.Name, Value: label.Value})
+		}
+	}
+	if !hasLabel(tc.Labels, "suite") {
+		tc.Labels = append(tc.Labels, Label{Name: "suite", Value: allure1Title(suite.Title, suite.Name)})
+	}
+
+	tc.Attachments = allure1Attachments(c.Attachments)
+	tc.Steps = allure1Steps(c.Steps)
+	tc.normalizeStatuses()
+
+	return tc
+}
+
+func allure1Steps(steps []Allure1Step) []Step {
+	var converted []Step
+	for _, step := range steps {
+		converted = append(converted, Step{
+			Name:        allure1Title(step.Title, step.Name),
+			Status:      allure1Status(step.Status),
+			Start:       step.Start,
+			Stop:        step.Stop,
+			Attachments: allure1Attachments(step.Attachments),
+			Steps:       allure1Steps(step.Steps),
+		})
+	}
+	return converted
+}
+
+func allure1Attachments(attachments []Allure1Attachment) []Attachment {
+	var converted []Attachment
+	for _, a := range attachments {
+		converted = append(converted, Attachment{Name: a.Title, Source: a.Source, Type: a.Type, Size: a.Size})
+	}
+	return converted
+}
+
+// В Allure 1 name — имя метода, а человекочитаемое имя лежит в title
+func allure1Title(title, name string) string {
+	if title != "" {
+		return title
+	}
+	return name
+}
+
+// Allure 2 показывает canceled и pending из Allure 1 как skipped
+func allure1Status(status string) string {
+	switch status {
+	case "canceled", "pending":
+		return "skipped"
+	}
+	return status
+}
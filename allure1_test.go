@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAllure1Report(t *testing.T) {
+	setupConfig(t, "-format", "allure1")
+
+	snap, err := parseDir(t, filepath.Join("testdata", "allure1"))
+	if err != nil {
+		t.Fatalf("parse allure1 report: %v", err)
+	}
+	if snap.FormatVersion != "1.5.4" {
+		t.Errorf("format version = %q, want 1.5.4", snap.FormatVersion)
+	}
+	if got := snap.Environment["browser"]; got != "firefox" {
+		t.Errorf("environment browser = %q, want firefox", got)
+	}
+
+	want := AllureSummary{}
+	want.Statistic.Passed, want.Statistic.Failed, want.Statistic.Skipped = 1, 1, 1
+	want.Time.Duration = 10000
+	if *snap.Summary != want {
+		t.Errorf("summary = %+v, want %+v", *snap.Summary, want)
+	}
+
+	tests := []struct {
+		name     string
+		status   string
+		duration int64
+		labels   map[string]string
+		steps    int
+	}{
+		// title заменяет имя метода, метки сьюта достаются тест-кейсу
+		{name: "Add item to cart", status: "passed", duration: 2000, steps: 1,
+			labels: map[string]string{"severity": "critical", "feature": "cart", "suite": "Cart"}},
+		// Собственная метка теста важнее одноименной метки сьюта
+		{name: "removeItem", status: "failed", duration: 8000,
+			labels: map[string]string{"severity": "normal", "feature": "checkout", "suite": "Cart"}},
+		// canceled в Allure 1 соответствует skipped
+		{name: "checkout", status: "skipped", duration: 0,
+			labels: map[string]string{"feature": "cart", "suite": "Cart"}},
+	}
+	if snap.TestCasesFound != len(tests) {
+		t.Fatalf("test cases = %d, want %d", snap.TestCasesFound, len(tests))
+	}
+
+	// Снимок хранит только метрики, поэтому преобразование тест-кейсов
+	// проверяется на самом тест-сьюте
+	suite, err := parseAllure1Suite(os.DirFS(filepath.Join("testdata", "allure1")), "cart-testsuite.xml")
+	if err != nil {
+		t.Fatalf("parse test suite: %v", err)
+	}
+	if len(suite.TestCases) != len(tests) {
+		t.Fatalf("suite test cases = %d, want %d", len(suite.TestCases), len(tests))
+	}
+	m := buildReportMetrics(snap)
+	for i, tt := range tests {
+		tc := suite.TestCases[i].testCase(suite)
+		if tc.Name != tt.name || tc.Status != tt.status {
+			t.Errorf("test case %d = %q %s, want %q %s", i, tc.Name, tc.Status, tt.name, tt.status)
+		}
+		if got := tc.Stop - tc.Start; got != tt.duration {
+			t.Errorf("%s: duration = %dms, want %dms", tt.name, got, tt.duration)
+		}
+		if len(tc.Steps) != tt.steps {
+			t.Errorf("%s: steps = %d, want %d", tt.name, len(tc.Steps), tt.steps)
+		}
+		for name, value := range tt.labels {
+			if got := getLabelValue(tc.Labels, name); got != value {
+				t.Errorf("%s: label %s = %q, want %q", tt.name, name, got, value)
+			}
+		}
+		status := m.testStatus.WithLabelValues(tt.name, tt.status, tt.labels["severity"], "unknown")
+		if got := testutil.ToFloat64(status); got != cfg.statusValues[tt.status] {
+			t.Errorf("%s: allure_test_status = %v, want %v", tt.name, got, cfg.statusValues[tt.status])
+		}
+	}
+	if msg := suite.TestCases[1].testCase(suite).StatusDetails.Message; msg != "expected 0 items" {
+		t.Errorf("failure message = %q, want %q", msg, "expected 0 items")
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		name      string
+		testCases []*AllureTestCase
+		passed    int
+		failed    int
+		broken    int
+		skipped   int
+		duration  int64
+	}{
+		{name: "empty"},
+		{
+			name: "statuses and span",
+			testCases: []*AllureTestCase{
+				{Status: "passed", Start: 1000, Stop: 3000},
+				{Status: "failed", Start: 2000, Stop: 6000},
+				{Status: "broken", Start: 4000, Stop: 5000},
+				{Status: "skipped"},
+				{Status: "pending", Start: 1500, Stop: 2500},
+				nil,
+			},
+			passed: 1, failed: 1, broken: 1, skipped: 1, duration: 5000,
+		},
+		{
+			name:      "no timestamps",
+			testCases: []*AllureTestCase{{Status: "passed"}, {Status: "passed"}},
+			passed:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := summarize(tt.testCases)
+			s := got.Statistic
+			if s.Passed != tt.passed || s.Failed != tt.failed || s.Broken != tt.broken || s.Skipped != tt.skipped {
+				t.Errorf("statistic = %+v, want passed %d failed %d broken %d skipped %d",
+					s, tt.passed, tt.failed, tt.broken, tt.skipped)
+			}
+			if got.Time.Duration != tt.duration {
+				t.Errorf("duration = %d, want %d", got.Time.Duration, tt.duration)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Prometheus запрашивает /metrics с Accept-Encoding: gzip и получает сжатый ответ;
+// клиент без gzip получает обычный текст
+func TestMetricsGzip(t *testing.T) {
+	setupConfig(t)
+	if _, err := parseDir(t, filepath.Join("testdata", "no-history")); err != nil {
+		t.Fatalf("parse report: %v", err)
+	}
+	mux := http.NewServeMux()
+	registerHandlers(mux, mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		gzipped  bool
+	}{
+		{name: "gzip", encoding: "gzip", gzipped: true},
+		{name: "identity", encoding: "identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Заголовок задан явно, поэтому транспорт не распаковывает ответ сам
+			req.Header.Set("Accept-Encoding", tt.encoding)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tt.gzipped {
+				t.Fatalf("Content-Encoding = %q, want gzip %v", resp.Header.Get("Content-Encoding"), tt.gzipped)
+			}
+			var body io.Reader = resp.Body
+			if tt.gzipped {
+				zr, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatalf("gzip body: %v", err)
+				}
+				defer zr.Close()
+				body = zr
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("read body: %v", err)
+			}
+			if !strings.Contains(string(data), `allure_tests_total{status="passed"} 1`) {
+				t.Errorf("metrics do not contain allure_tests_total of the parsed report:\n%.500s", data)
+			}
+		})
+	}
+}
+
+// pass_rate сьюта в /status.json считается так же, как allure_feature_pass_ratio:
+// пропущенные тесты не входят в знаменатель
+func TestStatusPassRateMatchesFeatureRatio(t *testing.T) {
+	setupConfig(t)
+	resetCollector(t)
+
+	labels := `"labels":[{"name":"suite","value":"cart"},{"name":"feature","value":"cart"}]`
+	snap := snapshotOf(
+		testCase(t, `{"name":"add","status":"passed",`+labels+`}`),
+		testCase(t, `{"name":"remove","status":"failed",`+labels+`}`),
+		testCase(t, `{"name":"pay","status":"skipped",`+labels+`}`),
+		testCase(t, `{"name":"draft","status":"skipped","labels":[{"name":"suite","value":"drafts"}]}`),
+	)
+	reportCollector.publish("", snap)
+
+	rec := httptest.NewRecorder()
+	statusJSON(rec, httptest.NewRequest(http.MethodGet, "/status.json", nil))
+	var doc statusDocument
+	if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if len(doc.Projects) != 1 {
+		t.Fatalf("projects = %+v, want one", doc.Projects)
+	}
+
+	rates := make(map[string]*float64)
+	for _, suite := range doc.Projects[0].Suites {
+		rates[suite.Suite] = suite.PassRate
+	}
+	want := testutil.ToFloat64(buildReportMetrics(snap).featurePassRatio.WithLabelValues("cart"))
+	if got := rates["cart"]; got == nil || *got != want {
+		t.Errorf("cart pass_rate = %v, want allure_feature_pass_ratio %v", got, want)
+	}
+	if want != 0.5 {
+		t.Errorf("allure_feature_pass_ratio = %v, want 0.5", want)
+	}
+	if got := rates["drafts"]; got != nil {
+		t.Errorf("drafts pass_rate = %v, want none for a suite of skipped tests", *got)
+	}
+}
@@ -1,17 +1,39 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"html"
+	"io"
+	"io/fs"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"go.uber.org/zap"
 )
 
@@ -19,6 +41,14 @@ import (
 type (
 	AllureEnvironment map[string]string
 
+	AllureExecutor struct {
+		Name      string `json:"name"`
+		Type      string `json:"type"`
+		URL       string `json:"url"`
+		BuildName string `json:"buildName"`
+		BuildURL  string `json:"buildUrl"`
+	}
+
 	AllureSummary struct {
 		Statistic struct {
 			Passed  int `json:"passed"`
@@ -32,13 +62,27 @@ type (
 	}
 
 	AllureTestCase struct {
-		UUID    string `json:"uuid"`
-		Name    string `json:"name"`
-		Status  string `json:"status"`
-		Start   int64  `json:"start"`
-		Stop    int64  `json:"stop"`
-		Labels  []Label `json:"labels"`
-		Steps   []Step  `json:"steps"`
+		UUID          string        `json:"uuid"`
+		Name          string        `json:"name"`
+		Status        string        `json:"status"`
+		Start         int64         `json:"start"`
+		Stop          int64         `json:"stop"`
+		Labels        []Label       `json:"labels"`
+		Steps         []Step        `json:"steps"`
+		StatusDetails StatusDetails `json:"statusDetails"`
+		Attachments   []Attachment  `json:"attachments"`
+		RetriesCount  int           `json:"retriesCount"`
+	}
+
+	Attachment struct {
+		Name   string `json:"name"`
+		Source string `json:"source"`
+		Type   string `json:"type"`
+		Size   int64  `json:"size"`
+	}
+
+	StatusDetails struct {
+		Message string `json:"message"`
 	}
 
 	Label struct {
@@ -47,376 +91,3940 @@ type (
 	}
 
 	Step struct {
-		Name   string `json:"name"`
-		Status string `json:"status"`
+		Name        string       `json:"name"`
+		Status      string       `json:"status"`
+		Start       int64        `json:"start"`
+		Stop        int64        `json:"stop"`
+		Attachments []Attachment `json:"attachments"`
+		Steps       []Step       `json:"steps"`
 	}
 
 	AllureHistoryTrend struct {
 		Items []HistoryItem `json:"items"`
 	}
 
+	// Дерево widgets/packages.json: узлы-пакеты с вложенными узлами, листья — тесты со статусом
+	AllurePackages struct {
+		Children []PackageNode `json:"children"`
+	}
+
+	PackageNode struct {
+		Name     string        `json:"name"`
+		Status   string        `json:"status"`
+		Children []PackageNode `json:"children"`
+	}
+
 	HistoryItem struct {
 		Data struct {
-			Failed int `json:"failed"`
+			Failed  int `json:"failed"`
+			Broken  int `json:"broken"`
+			Skipped int `json:"skipped"`
+			Passed  int `json:"passed"`
+			Unknown int `json:"unknown"`
+			Total   int `json:"total"`
 		} `json:"data"`
 	}
 )
 
+// Общее число тестов по статистике summary
+func (s *AllureSummary) total() int {
+	return s.Statistic.Passed + s.Statistic.Failed + s.Statistic.Broken + s.Statistic.Skipped
+}
+
+// Добавляет статистику и длительность summary другого шарда
+func (s *AllureSummary) add(other *AllureSummary) {
+	s.Statistic.Passed += other.Statistic.Passed
+	s.Statistic.Failed += other.Statistic.Failed
+	s.Statistic.Broken += other.Statistic.Broken
+	s.Statistic.Skipped += other.Statistic.Skipped
+	s.Time.Duration += other.Time.Duration
+}
+
+// Настройки запуска
+type config struct {
+	port   string
+	socket string
+
+	metricsAddr string
+	adminAddr   string
+
+	normalizeNames   bool
+	normalizePattern string
+	nameNormalizer   *regexp.Regexp
+
+	failureThreshold        string
+	failureThresholdValue   float64
+	failureThresholdPercent bool
+
+	perTestStatusList string
+	perTestStatuses   map[string]bool
+
+	maxFileSize int64
+
+	baselineBuilds int
+
+	labelAllowList string
+	labelAllow     map[string]map[string]bool
+	labelMaxValues int
+
+	profileParse bool
+
+	durationBucketList string
+	durationBuckets    []float64
+	parseBucketList    string
+	parseBuckets       []float64
+
+	skipUnchanged bool
+
+	includeSuitePrefix string
+
+	manifest string
+
+	recursive bool
+
+	slaList string
+	sla     map[string]time.Duration
+
+	statusValueList string
+	statusValues    map[string]float64
+
+	format string
+
+	cacheTTL time.Duration
+
+	interval time.Duration
+	output   string
+
+	timeoutPatternList string
+	timeoutPatterns    []string
+
+	minTestsReady int
+
+	unhealthyOnErrors bool
+	maxParseErrors    int
+
+	parseWorkers int
+
+	readRetries int
+
+	statusAliasList string
+	statusAliases   map[string]string
+
+	screenshotTypeList string
+	screenshotTypes    map[string]bool
+
+	exitOnFailures int
+
+	historyPath string
+
+	envLabel string
+
+	allLabels bool
+
+	requireComplete   bool
+	completeTolerance float64
+
+	unknownLabelValue string
+
+	emitCounters bool
+
+	maxHealthPause time.Duration
+
+	outputFormat string
+
+	since time.Duration
+
+	pathPrefix string
+
+	project string
+
+	sourceTimeout time.Duration
+
+	resetMode string
+
+	caCert   string
+	insecure bool
+
+	weightList string
+	weights    map[string]float64
+
+	minPerTestSeverity string
+
+	snapshotEndpoint bool
+}
+
 // Глобальные переменные
 var (
+	cfg config
+
 	logger *zap.Logger
-	lastParseTime time.Time
-
-	// Реестр метрик
-	metrics = struct {
-		testsTotal       *prometheus.GaugeVec
-		suiteDuration    prometheus.Gauge
-		testDuration     *prometheus.GaugeVec
-		testStatus       *prometheus.GaugeVec
-		flakyRatio       prometheus.Gauge
-		environmentInfo  *prometheus.GaugeVec
-		historyTrend     *prometheus.GaugeVec
-		testsByLabel     *prometheus.GaugeVec
-		stepsTotal       *prometheus.GaugeVec
+
+	// Время последней публикации снимка (UnixNano); источники публикуют параллельно
+	lastParseTime int64
+
+	// Источники из -manifest по имени проекта; переживают перечитывание манифеста
+	manifestSources = make(map[string]*reportSource)
+
+	// Цикл парсинга перечитывает манифест и обновляет источники, поэтому одновременно идет только один
+	parseMu sync.Mutex
+
+	// Запросы на парсинг: буфер в один элемент схлопывает частые триггеры
+	parseTrigger  = make(chan struct{}, 1)
+	pendingParses int64
+
+	// До этого момента (UnixNano) устаревание данных не делает /health красным
+	healthPausedUntil int64
+
+	// Метрики экспортера, накапливаются между циклами
+	exporterMetrics = struct {
+		parseQueueDepth prometheus.Gauge
+		filesTooLarge   prometheus.Counter
+		testcaseParse   prometheus.Histogram
+		testsProcessed  *prometheus.CounterVec
+		parseAllocBytes prometheus.Gauge
+		readRetries     *prometheus.CounterVec
+		sourceDuration  *prometheus.GaugeVec
+		sourceErrors    *prometheus.CounterVec
+
+		consecutiveFailures prometheus.Gauge
 	}{
-		testsTotal: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "allure_tests_total",
-				Help: "Total tests by status",
-			},
-			[]string{"status"},
-		),
-		suiteDuration: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name: "allure_suite_duration_seconds",
-				Help: "Test suite duration",
-			},
-		),
-		testDuration: prometheus.NewGaugeVec(
+		parseQueueDepth: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "allure_test_duration_seconds",
-				Help: "Individual test duration",
+				Name: "allure_parse_queue_depth",
+				Help: "Parse requests pending since the current parse started",
 			},
-			[]string{"name", "suite"},
 		),
-		testStatus: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "allure_test_status",
-				Help: "Test status (1-passed, 0-failed/broken)",
+		filesTooLarge: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "allure_files_skipped_too_large_total",
+				Help: "Report files skipped for exceeding -max-file-size",
 			},
-			[]string{"name", "status", "severity"},
 		),
-		flakyRatio: prometheus.NewGauge(
+		parseAllocBytes: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "allure_flaky_tests_ratio",
-				Help: "Ratio of flaky tests",
+				Name: "allure_parse_alloc_bytes",
+				Help: "Heap allocated bytes sampled at the end of the last parse",
 			},
 		),
-		environmentInfo: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "allure_environment_info",
-				Help: "Test environment information",
+		readRetries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "allure_file_read_retries_total",
+				Help: "Report file reads retried after a transient error",
 			},
-			[]string{"key", "value"},
+			[]string{"stage"},
 		),
-		historyTrend: prometheus.NewGaugeVec(
+		sourceDuration: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "allure_history_failed_tests",
-				Help: "Failed tests history trend",
+				Name: "allure_source_parse_duration_seconds",
+				Help: "Duration of the last finished parse of each report source",
 			},
-			[]string{"build"},
+			[]string{"project"},
 		),
-		testsByLabel: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: "allure_tests_by_label",
-				Help: "Tests grouped by label",
+		sourceErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "allure_source_parse_errors_total",
+				Help: "Failed or timed out parses of each report source",
 			},
-			[]string{"label_type", "label_value"},
+			[]string{"project"},
 		),
-		stepsTotal: prometheus.NewGaugeVec(
+		consecutiveFailures: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "allure_test_steps_total",
-				Help: "Test steps by status",
+				Name: "allure_consecutive_parse_failures",
+				Help: "Parse cycles failed in a row, reset on success",
 			},
-			[]string{"test_name", "status"},
 		),
 	}
-)
-
-func init() {
-	// Инициализация логгера
-	var err error
-	logger, err = zap.NewProduction()
-	if err != nil {
-		fmt.Printf("Failed to init logger: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Регистрация метрик
-	prometheus.MustRegister(metrics.testsTotal)
-	prometheus.MustRegister(metrics.suiteDuration)
-	prometheus.MustRegister(metrics.testDuration)
-	prometheus.MustRegister(metrics.testStatus)
-	prometheus.MustRegister(metrics.flakyRatio)
-	prometheus.MustRegister(metrics.environmentInfo)
-	prometheus.MustRegister(metrics.historyTrend)
-	prometheus.MustRegister(metrics.testsByLabel)
-	prometheus.MustRegister(metrics.stepsTotal)
-}
-
-func main() {
-	defer logger.Sync()
 
-	if len(os.Args) < 2 {
-		logger.Fatal("Usage: ./allure-parser <path-to-allure-results> [<port>]")
-	}
+	// Внешний файл истории из -history-path
+	historyFS   fs.FS
+	historyFile string
 
-	port := "8080"
-	if len(os.Args) > 2 {
-		port = os.Args[2]
-	}
+	// Опубликованные снимки отчетов по проектам, которые видят скрейпы
+	reportCollector = &snapshotCollector{reports: make(map[string]*publishedReport), errors: make(map[string]string)}
+)
 
-	// Запуск парсера
-	go runParser(os.Args[1])
+// Источник отчета и состояние, которое нужно сохранять между циклами
+type reportSource struct {
+	project  string
+	location string
+	fsys     fs.FS
 
-	// HTTP сервер
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/health", healthCheck)
+	// Хэш окружения для allure_environment_changed
+	envHash string
+	// Разбор источника не идет параллельно сам с собой: с -source-timeout
+	// зависший разбор может пережить свой цикл
+	mu sync.Mutex
 
-	logger.Info("Starting server", zap.String("port", port))
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		logger.Fatal("Server failed", zap.Error(err))
-	}
+	// Отпечаток последнего успешного цикла для -skip-unchanged
+	fingerprint string
+	// Статусы тестов прошлого цикла по имени для allure_test_status_changes_total
+	testStatuses map[string]string
 }
 
-func runParser(path string) {
-	// Первоначальный парсинг
-	if err := parseAllureReports(path); err != nil {
-		logger.Error("Initial parse failed", zap.Error(err))
-	}
-
-	// Периодическое обновление
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		if err := parseAllureReports(path); err != nil {
-			logger.Error("Periodic parse failed", zap.Error(err))
-		}
-	}
+// Запись манифеста -manifest
+type manifestEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
 }
 
-func parseAllureReports(path string) error {
-	startTime := time.Now()
-	defer func() {
-		lastParseTime = time.Now()
-		logger.Info("Parsing completed", 
-			zap.Duration("duration", time.Since(startTime)))
-	}()
+// Разобранный отчет последнего цикла; метрики по нему строятся при скрейпе
+type ReportSnapshot struct {
+	Environment AllureEnvironment   `json:"environment"`
+	Executor    *AllureExecutor     `json:"executor"`
+	Summary     *AllureSummary      `json:"summary"`
+	History     *AllureHistoryTrend `json:"history"`
+	Packages    *AllurePackages     `json:"packages"`
 
-	// Сброс старых метрик
-	resetMetrics()
-
-	// 1. Парсинг environment
-	if err := parseEnvironment(filepath.Join(path, "environment.json")); err != nil {
-		logger.Warn("Environment parse failed", zap.Error(err))
-	}
+	// Тесты по сьютам; сами тест-кейсы в снимке не хранятся, каждый учитывается
+	// в метриках сразу после чтения
+	Suites map[string]*SuiteCounts `json:"suites"`
 
-	// 2. Парсинг summary
-	summary, err := parseSummary(filepath.Join(path, "widgets", "summary.json"))
-	if err != nil {
-		return fmt.Errorf("summary parse failed: %w", err)
-	}
-	updateSummaryMetrics(summary)
+	// Сведения, известные только во время чтения отчета
+	EnvHash        string        `json:"env_hash"`
+	EnvChanged     bool          `json:"env_changed"`
+	TestCaseFiles  int           `json:"test_case_files"`
+	TestCasesFound int           `json:"test_cases_found"`
+	FilteredOut    int           `json:"filtered_out"`
+	TooOld         int           `json:"too_old"`
+	StatusChanges  int           `json:"status_changes"`
+	DuplicateUUIDs int           `json:"duplicate_uuids"`
+	ParseErrors    int           `json:"parse_errors"`
+	OrphanedFiles  int           `json:"orphaned_files"`
+	NewestModTime  time.Time     `json:"newest_mod_time"`
+	LastTestStart  time.Time     `json:"last_test_start"`
+	ParsedAt       time.Time     `json:"parsed_at"`
+	ParseDuration  time.Duration `json:"parse_duration_ns"`
+	FormatVersion  string        `json:"format_version"`
 
-	// 3. Парсинг history trend
-	if history, err := parseHistoryTrend(filepath.Join(path, "widgets", "history-trend.json")); err == nil {
-		updateHistoryMetrics(history)
-	} else {
-		logger.Warn("History trend parse failed", zap.Error(err))
-	}
+	// Сырые allure-results без summary: разобраны только контейнеры, и отсутствие
+	// summary не считается сбоем
+	Raw bool `json:"raw"`
 
-	// 4. Парсинг тест-кейсов
-	testFiles, err := filepath.Glob(filepath.Join(path, "data", "test-cases", "*.json"))
-	if err != nil {
-		return fmt.Errorf("test cases glob failed: %w", err)
-	}
+	// Итог каждой стадии разбора: "ok" или текст ошибки
+	Stages map[string]string `json:"stages"`
 
-	for _, testFile := range testFiles {
-		tc, err := parseTestCase(testFile)
-		if err != nil {
-			logger.Warn("Test case parse failed", 
-				zap.String("file", testFile), 
-				zap.Error(err))
-			continue
-		}
-		updateTestCaseMetrics(tc)
-	}
+	// Метрики тест-кейсов, собранные при чтении
+	tests *testCaseMetrics
 
-	return nil
+	// Первый файл с каждым uuid и статусы тестов по имени для trackStatuses;
+	// нужны только во время чтения и освобождаются при публикации
+	seenUUIDs    map[string]string
+	testStatuses map[string]string
 }
 
-func resetMetrics() {
-	metrics.testsTotal.Reset()
-	metrics.testDuration.Reset()
-	metrics.testStatus.Reset()
-	metrics.environmentInfo.Reset()
-	metrics.historyTrend.Reset()
-	metrics.testsByLabel.Reset()
-	metrics.stepsTotal.Reset()
+// Тесты одного сьюта для средней длительности и /status.json
+type SuiteCounts struct {
+	Total           int     `json:"total"`
+	Passed          int     `json:"passed"`
+	Failed          int     `json:"failed"`
+	Broken          int     `json:"broken"`
+	Skipped         int     `json:"skipped"`
+	DurationSeconds float64 `json:"duration_seconds"`
 }
 
-// Парсинг отдельных файлов
-func parseEnvironment(path string) error {
-	data, err := ioutil.ReadFile(path)
+// Запоминает итог стадии разбора для отчета проверки
+func (s *ReportSnapshot) stage(name string, err error) {
+	if s.Stages == nil {
+		s.Stages = make(map[string]string)
+	}
 	if err != nil {
-		return fmt.Errorf("read file: %w", err)
+		s.Stages[name] = err.Error()
+		return
 	}
+	s.Stages[name] = "ok"
+}
 
-	var env AllureEnvironment
-	if err := json.Unmarshal(data, &env); err != nil {
-		return fmt.Errorf("json unmarshal: %w", err)
+// Сходится ли число тест-кейсов с итогом summary с допуском tolerance (доля от итога)
+func (s *ReportSnapshot) complete(tolerance float64) bool {
+	if s.Summary == nil {
+		return true
 	}
-
-	for k, v := range env {
-		metrics.environmentInfo.WithLabelValues(k, v).Set(1)
+	total := s.Summary.total()
+	diff := total - s.TestCasesFound
+	if diff < 0 {
+		diff = -diff
 	}
-
-	return nil
+	return float64(diff) <= tolerance*float64(total)
 }
 
-func parseSummary(path string) (*AllureSummary, error) {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("read file: %w", err)
-	}
+// Добавляет тест-кейс в снимок с учетом фильтров по сьюту и -since; origin — файл, откуда он прочитан
+func (s *ReportSnapshot) addTestCase(tc *AllureTestCase, origin string) {
+	s.TestCasesFound++
+	tc.fillTimesFromSteps()
 
-	var summary AllureSummary
-	if err := json.Unmarshal(data, &summary); err != nil {
-		return nil, fmt.Errorf("json unmarshal: %w", err)
+	// Повтор uuid указывает на ошибку сборки отчета
+	if tc.UUID != "" {
+		if s.seenUUIDs == nil {
+			s.seenUUIDs = make(map[string]string)
+		}
+		if first, ok := s.seenUUIDs[tc.UUID]; ok {
+			s.DuplicateUUIDs++
+			logger.Debug("Duplicate test case uuid",
+				zap.String("uuid", tc.UUID),
+				zap.String("file", origin),
+				zap.String("first_file", first))
+		} else {
+			s.seenUUIDs[tc.UUID] = origin
+		}
 	}
 
-	return &summary, nil
-}
-
-func parseHistoryTrend(path string) (*AllureHistoryTrend, error) {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("read file: %w", err)
+	// Тесты чужих сьютов только учитываются в счетчике отфильтрованных
+	if cfg.includeSuitePrefix != "" && !strings.HasPrefix(getLabelValue(tc.Labels, "suite"), cfg.includeSuitePrefix) {
+		s.FilteredOut++
+		return
 	}
 
-	var history AllureHistoryTrend
-	if err := json.Unmarshal(data, &history); err != nil {
-		return nil, fmt.Errorf("json unmarshal: %w", err)
+	// В накопительном отчете старые результаты только учитываются; тесты без start остаются
+	if cfg.since > 0 && tc.Start > 0 && time.UnixMilli(tc.Start).Before(time.Now().Add(-cfg.since)) {
+		s.TooOld++
+		return
 	}
 
-	return &history, nil
-}
-
-func parseTestCase(path string) (*AllureTestCase, error) {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("read file: %w", err)
+	if s.tests == nil {
+		s.tests = newTestCaseMetrics()
+		s.Suites = make(map[string]*SuiteCounts)
+		s.testStatuses = make(map[string]string)
 	}
+	s.tests.add(tc)
+	s.testStatuses[tc.Name] = tc.Status
 
-	var tc AllureTestCase
-	if err := json.Unmarshal(data, &tc); err != nil {
-		return nil, fmt.Errorf("json unmarshal: %w", err)
+	name := getLabelValue(tc.Labels, "suite")
+	suite := s.Suites[name]
+	if suite == nil {
+		suite = &SuiteCounts{}
+		s.Suites[name] = suite
 	}
+	suite.Total++
+	switch tc.Status {
+	case "passed":
+		suite.Passed++
+	case "failed":
+		suite.Failed++
+	case "broken":
+		suite.Broken++
+	case "skipped":
+		suite.Skipped++
+	}
+	suite.DurationSeconds += float64(tc.Stop-tc.Start) / 1000
 
-	return &tc, nil
-}
-
-// Обновление метрик
-func updateSummaryMetrics(summary *AllureSummary) {
-	metrics.testsTotal.WithLabelValues("passed").Set(float64(summary.Statistic.Passed))
-	metrics.testsTotal.WithLabelValues("failed").Set(float64(summary.Statistic.Failed))
-	metrics.testsTotal.WithLabelValues("broken").Set(float64(summary.Statistic.Broken))
-	metrics.testsTotal.WithLabelValues("skipped").Set(float64(summary.Statistic.Skipped))
-	metrics.suiteDuration.Set(float64(summary.Time.Duration) / 1000)
+	if start := time.UnixMilli(tc.Start); tc.Start > 0 && start.After(s.LastTestStart) {
+		s.LastTestStart = start
+	}
 }
 
-func updateHistoryMetrics(history *AllureHistoryTrend) {
-	if len(history.Items) == 0 {
-		return
-	}
+// Метрики отчета: набор строится заново по каждому снимку. Метрики тест-кейсов
+// собираются при чтении отчета и общие у всех наборов одного снимка
+type reportMetrics struct {
+	*testCaseMetrics
 
-	failedCount := 0
-	for i, item := range history.Items {
-		metrics.historyTrend.WithLabelValues(fmt.Sprintf("build_%d", i)).Set(float64(item.Data.Failed))
-		if item.Data.Failed > 0 {
-			failedCount++
-		}
-	}
+	testsTotal       *prometheus.GaugeVec
+	suiteDuration    prometheus.Gauge
+	flakyRatio       prometheus.Gauge
+	environmentInfo  *prometheus.GaugeVec
+	historyTrend     *prometheus.GaugeVec
+	envChanged       prometheus.Gauge
+	envHashInfo      *prometheus.GaugeVec
+	suiteHealthy     prometheus.Gauge
+	failuresBaseline prometheus.Gauge
+	historyAvailable prometheus.Gauge
+	executorInfo     *prometheus.GaugeVec
+	runInfo          *prometheus.GaugeVec
+	filteredOut      prometheus.Gauge
+	tooOld           prometheus.Gauge
+	duplicateUUIDs   prometheus.Gauge
+	statusChanges    prometheus.Gauge
+	suiteAvgDuration *prometheus.GaugeVec
+	packageTests     *prometheus.GaugeVec
+	filesFound       prometheus.Gauge
+	newestModTime    prometheus.Gauge
+	environmentKeys  prometheus.Gauge
+	formatVersion    *prometheus.GaugeVec
+	historyTests     *prometheus.GaugeVec
+	reportAge        prometheus.Gauge
+	sinceLastStart   prometheus.Gauge
+	parseThroughput  prometheus.Gauge
+	summaryTotal     prometheus.Gauge
+	brokenToFailed   prometheus.Gauge
+	orphanedFiles    prometheus.Gauge
 
-	flakyRatio := float64(failedCount) / float64(len(history.Items))
-	metrics.flakyRatio.Set(flakyRatio)
+	// Значения меток allure_package_tests, уже выведенные этим набором
+	packageLabels labelLimits
 }
 
-func updateTestCaseMetrics(tc *AllureTestCase) {
-	// Длительность теста
-	duration := float64(tc.Stop-tc.Start) / 1000
-	metrics.testDuration.WithLabelValues(tc.Name, getLabelValue(tc.Labels, "suite")).Set(duration)
-
-	// Статус теста
-	statusValue := 0.0
-	if tc.Status == "passed" {
-		statusValue = 1.0
-	}
-	metrics.testStatus.WithLabelValues(
-		tc.Name, 
-		tc.Status, 
-		getLabelValue(tc.Labels, "severity"),
-	).Set(statusValue)
+// Метрики по отдельным тест-кейсам: тест-кейс учитывается сразу после чтения,
+// и в снимке остаются эти наборы, а не сами тест-кейсы
+type testCaseMetrics struct {
+	testDuration     *prometheus.GaugeVec
+	testStatus       *prometheus.GaugeVec
+	testsByLabel     *prometheus.GaugeVec
+	distinctTags     prometheus.Gauge
+	stepsTotal       *prometheus.GaugeVec
+	testNameInfo     *prometheus.GaugeVec
+	testsByHour      *prometheus.GaugeVec
+	testsNoSteps     prometheus.Gauge
+	failedAvgSteps   prometheus.Gauge
+	attachedRatio    prometheus.Gauge
+	unknownStatus    *prometheus.GaugeVec
+	durationHist     prometheus.Histogram
+	severityRank     *prometheus.GaugeVec
+	slowestStep      *prometheus.GaugeVec
+	attachmentBytes  *prometheus.GaugeVec
+	overSLA          *prometheus.GaugeVec
+	featurePassRatio *prometheus.GaugeVec
+	testMatrix       *prometheus.GaugeVec
+	timedOut         prometheus.Gauge
+	stepMismatch     prometheus.Gauge
+	failedStepDepth  *prometheus.GaugeVec
+	labelCoverage    *prometheus.GaugeVec
+	durationByStatus *prometheus.GaugeVec
+	testsByLayer     *prometheus.GaugeVec
+	noScreenshot     prometheus.Gauge
+	testsByEnv       *prometheus.GaugeVec
+	nameLength       prometheus.Histogram
+	retryCount       prometheus.Histogram
+	healthScore      *prometheus.GaugeVec
+	duplicateLabels  *prometheus.GaugeVec
 
-	// Шаги теста
-	stepsByStatus := make(map[string]int)
-	for _, step := range tc.Steps {
-		stepsByStatus[step.Status]++
-	}
-	for status, count := range stepsByStatus {
-		metrics.stepsTotal.WithLabelValues(tc.Name, status).Set(float64(count))
-	}
+	// Значения меток, уже выведенные в allure_tests_by_label этим набором
+	labels labelLimits
+	// Число тестов с каждым типом метки для allure_label_coverage_ratio
+	testsWithLabel map[string]int
 
-	// Группировка по тегам
-	for _, label := range tc.Labels {
-		if isUsefulLabel(label.Name) {
-			metrics.testsByLabel.WithLabelValues(label.Name, label.Value).Inc()
-		}
-	}
+	// Промежуточные итоги для метрик по всем тестам; finish переносит их в метрики
+	tests, withoutSteps, withAttachments, failed, failedSteps int
+	healthSum, healthWorst, healthBest                        float64
+	featurePassed, featureCounted                             map[string]int
+	tags                                                      map[string]bool
+	finishOnce                                                sync.Once
 }
 
-// Вспомогательные функции
-// Извлекает значение конкретного тега (label) из списка меток тест-кейса
-func getLabelValue(labels []Label, name string) string {
-	for _, label := range labels {
-		if strings.EqualFold(label.Name, name) {
-			return label.Value
-		}
-	}
-	return "unknown"
+// Значения меток, уже выведенные набором, для -label-allow и -label-max-values
+type labelLimits struct {
+	valuesSeen     map[string]map[string]bool
+	overflowLogged map[string]bool
 }
 
-// Определяет, нужно ли учитывать метку при экспорте в Prometheus
-func isUsefulLabel(name string) bool {
-	usefulLabels := map[string]bool{
-		"epic":      true,
-		"feature":   true,
-		"story":     true,
-		"severity":  true,
-		"owner":     true,
-		"layer":     true,
+func newLabelLimits() labelLimits {
+	return labelLimits{
+		valuesSeen:     make(map[string]map[string]bool),
+		overflowLogged: make(map[string]bool),
 	}
-	return usefulLabels[strings.ToLower(name)]
 }
 
-func healthCheck(w http.ResponseWriter, _ *http.Request) {
-	if time.Since(lastParseTime) > 5*time.Minute {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte("UNHEALTHY: Data is stale"))
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+func newReportMetrics() *reportMetrics {
+	return &reportMetrics{
+		testCaseMetrics: newTestCaseMetrics(),
+		testsTotal: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_total",
+				Help: "Total tests by status",
+			},
+			[]string{"status"},
+		),
+		suiteDuration: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_suite_duration_seconds",
+				Help: "Test suite duration",
+			},
+		),
+		flakyRatio: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_flaky_tests_ratio",
+				Help: "Ratio of flaky tests",
+			},
+		),
+		environmentInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_environment_info",
+				Help: "Test environment information",
+			},
+			[]string{"key", "value"},
+		),
+		historyTrend: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_history_failed_tests",
+				Help: "Failed tests history trend",
+			},
+			[]string{"build"},
+		),
+		envChanged: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_environment_changed",
+				Help: "Environment differs from the previous cycle (1-changed, 0-same)",
+			},
+		),
+		envHashInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_environment_hash_info",
+				Help: "Hash of the test environment",
+			},
+			[]string{"hash"},
+		),
+		suiteHealthy: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_suite_healthy",
+				Help: "Failed+broken tests within the configured threshold (1-healthy, 0-unhealthy)",
+			},
+		),
+		failuresBaseline: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_failures_vs_baseline",
+				Help: "Current failed tests minus the average failed count of recent history builds",
+			},
+		),
+		historyAvailable: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_history_available",
+				Help: "History trend parsed with at least one build (1-yes, 0-no)",
+			},
+		),
+		executorInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_executor_info",
+				Help: "CI executor that produced the report",
+			},
+			[]string{"name", "build_name", "build_url", "type"},
+		),
+		runInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_run_info",
+				Help: "Git commit and branch under test taken from the report environment",
+			},
+			[]string{"commit", "branch"},
+		),
+		filteredOut: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_filtered_out",
+				Help: "Test cases skipped by the suite prefix filter",
+			},
+		),
+		tooOld: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_too_old",
+				Help: "Test cases skipped for starting before the -since window",
+			},
+		),
+		duplicateUUIDs: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_duplicate_uuid_total",
+				Help: "Test case files whose uuid was already seen in this cycle",
+			},
+		),
+		statusChanges: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_test_status_changes_total",
+				Help: "Tests whose status differs from the previous parse cycle",
+			},
+		),
+		suiteAvgDuration: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_suite_avg_duration_seconds",
+				Help: "Average test duration per suite",
+			},
+			[]string{"suite"},
+		),
+		packageTests: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_package_tests_total",
+				Help: "Tests by package from widgets/packages.json and status",
+			},
+			[]string{"package", "status"},
+		),
+		filesFound: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_testcase_files_found",
+				Help: "Test case files found in the report",
+			},
+		),
+		newestModTime: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_newest_testcase_mtime_seconds",
+				Help: "Modification time of the newest test case file (unix seconds)",
+			},
+		),
+		environmentKeys: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_environment_keys_total",
+				Help: "Number of entries in the test environment",
+			},
+		),
+		formatVersion: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_report_format_version",
+				Help: "Major Allure version of the report format (0 if undetectable)",
+			},
+			[]string{"version"},
+		),
+		historyTests: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_history_tests",
+				Help: "Tests by status in history trend builds",
+			},
+			[]string{"build", "status"},
+		),
+		reportAge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_report_age_seconds",
+				Help: "Parse time minus the newest test case file modification time",
+			},
+		),
+		sinceLastStart: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_time_since_last_test_start_seconds",
+				Help: "Parse time minus the latest test case start time",
+			},
+		),
+		parseThroughput: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_parse_testcases_per_second",
+				Help: "Test cases read per second of the parse that produced the report",
+			},
+		),
+		summaryTotal: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_summary_total_tests",
+				Help: "Total tests according to the summary statistic",
+			},
+		),
+		brokenToFailed: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_broken_failed_ratio",
+				Help: "Broken tests per failed test; 0 when nothing failed",
+			},
+		),
+		orphanedFiles: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_orphaned_files_total",
+				Help: "Container files in raw allure-results referencing missing result files",
+			},
+		),
+		packageLabels: newLabelLimits(),
+	}
+}
+
+func newTestCaseMetrics() *testCaseMetrics {
+	return &testCaseMetrics{
+		testDuration: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_test_duration_seconds",
+				Help: "Individual test duration",
+			},
+			[]string{"name", "suite", "env"},
+		),
+		testStatus: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_test_status",
+				Help: "Test status mapped by -status-value (default 1-passed, 0-failed/broken)",
+			},
+			[]string{"name", "status", "severity", "env"},
+		),
+		testsByLabel: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_by_label",
+				Help: "Tests grouped by label",
+			},
+			[]string{"label_type", "label_value"},
+		),
+		stepsTotal: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_test_steps_total",
+				Help: "Test steps by status",
+			},
+			[]string{"test_name", "status"},
+		),
+		testNameInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_test_name_info",
+				Help: "Raw test name behind a normalized name",
+			},
+			[]string{"name", "raw_name"},
+		),
+		testsByHour: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_by_hour",
+				Help: "Tests by hour of day (UTC) of their start time",
+			},
+			[]string{"hour"},
+		),
+		testsNoSteps: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_without_steps_total",
+				Help: "Test cases without any recorded steps",
+			},
+		),
+		failedAvgSteps: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_avg_steps_per_failed_test",
+				Help: "Average number of steps, nested included, in failed and broken tests",
+			},
+		),
+		attachedRatio: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_with_attachments_ratio",
+				Help: "Share of tests with at least one attachment on the test or its steps",
+			},
+		),
+		unknownStatus: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_unknown_status_total",
+				Help: "Test cases with a status outside passed/failed/broken/skipped",
+			},
+			[]string{"status"},
+		),
+		durationHist: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "allure_tests_duration_seconds",
+				Help:    "Distribution of test durations",
+				Buckets: cfg.durationBuckets,
+			},
+		),
+		severityRank: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_test_severity_rank",
+				Help: "Test severity as a number (blocker=4, critical=3, normal=2, minor=1, trivial=0)",
+			},
+			[]string{"name"},
+		),
+		slowestStep: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_test_slowest_step_seconds",
+				Help: "Duration of the slowest step of a test",
+			},
+			[]string{"test_name", "step_name"},
+		),
+		attachmentBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_test_attachment_bytes",
+				Help: "Total size of attachments of a test and its steps",
+			},
+			[]string{"name"},
+		),
+		overSLA: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_over_sla_total",
+				Help: "Tests whose duration exceeds the -sla threshold for their severity",
+			},
+			[]string{"severity"},
+		),
+		featurePassRatio: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_feature_pass_ratio",
+				Help: "Share of passed tests among passed, failed and broken per feature label",
+			},
+			[]string{"feature"},
+		),
+		testMatrix: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_test_matrix",
+				Help: "Tests by suite, status and severity",
+			},
+			[]string{"suite", "status", "severity"},
+		),
+		timedOut: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_timed_out_total",
+				Help: "Broken tests whose status message matches -timeout-patterns",
+			},
+		),
+		stepMismatch: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_test_step_status_mismatch_total",
+				Help: "Tests whose step statuses contradict the test status",
+			},
+		),
+		failedStepDepth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_failed_steps_by_depth",
+				Help: "Failed and broken steps by nesting depth, 1 for top-level steps",
+			},
+			[]string{"depth"},
+		),
+		labelCoverage: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_label_coverage_ratio",
+				Help: "Share of tests carrying each exported label type",
+			},
+			[]string{"label_type"},
+		),
+		durationByStatus: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_duration_by_status_seconds",
+				Help: "Total test duration by status",
+			},
+			[]string{"status"},
+		),
+		testsByLayer: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_by_layer",
+				Help: "Tests by layer label (unit, integration, e2e) and status",
+			},
+			[]string{"layer", "status"},
+		),
+		noScreenshot: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_failed_without_screenshot_total",
+				Help: "Failed or broken tests without a screenshot attachment (-screenshot-types)",
+			},
+		),
+		testsByEnv: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_by_env_total",
+				Help: "Tests by status and environment taken from the -env-label test label",
+			},
+			[]string{"env", "status"},
+		),
+		nameLength: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "allure_test_name_length",
+				Help:    "Distribution of raw test name lengths in characters",
+				Buckets: prometheus.ExponentialBuckets(16, 2, 6),
+			},
+		),
+		retryCount: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "allure_test_retry_count",
+				Help:    "Distribution of per-test retry counts (retriesCount of the test case)",
+				Buckets: []float64{0, 1, 2, 3, 5},
+			},
+		),
+		distinctTags: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "allure_distinct_tags",
+				Help: "Distinct tag label values across all tests of the report",
+			},
+		),
+		// Без меток: серия появляется, только когда в отчете есть тесты
+		healthScore: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_suite_health_score",
+				Help: "Suite health from 0 to 100: status weights (-weight) scaled by severity rank + 1",
+			},
+			nil,
+		),
+		duplicateLabels: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "allure_tests_with_duplicate_labels_total",
+				Help: "Tests carrying more than one value of a single-valued label (suite, severity, owner, layer, -env-label)",
+			},
+			[]string{"label"},
+		),
+		labels:         newLabelLimits(),
+		testsWithLabel: make(map[string]int),
+		featurePassed:  make(map[string]int),
+		featureCounted: make(map[string]int),
+		tags:           make(map[string]bool),
+	}
+}
+
+// Все метрики набора для Describe/Collect
+func (m *reportMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.testsTotal,
+		m.suiteDuration,
+		m.testDuration,
+		m.testStatus,
+		m.flakyRatio,
+		m.environmentInfo,
+		m.historyTrend,
+		m.testsByLabel,
+		m.distinctTags,
+		m.stepsTotal,
+		m.testNameInfo,
+		m.envChanged,
+		m.envHashInfo,
+		m.suiteHealthy,
+		m.testsByHour,
+		m.testsNoSteps,
+		m.failedAvgSteps,
+		m.attachedRatio,
+		m.unknownStatus,
+		m.failuresBaseline,
+		m.durationHist,
+		m.historyAvailable,
+		m.executorInfo,
+		m.runInfo,
+		m.severityRank,
+		m.filteredOut,
+		m.tooOld,
+		m.duplicateUUIDs,
+		m.statusChanges,
+		m.slowestStep,
+		m.attachmentBytes,
+		m.overSLA,
+		m.suiteAvgDuration,
+		m.featurePassRatio,
+		m.packageTests,
+		m.testMatrix,
+		m.timedOut,
+		m.stepMismatch,
+		m.failedStepDepth,
+		m.labelCoverage,
+		m.durationByStatus,
+		m.filesFound,
+		m.newestModTime,
+		m.testsByLayer,
+		m.noScreenshot,
+		m.environmentKeys,
+		m.formatVersion,
+		m.historyTests,
+		m.testsByEnv,
+		m.reportAge,
+		m.sinceLastStart,
+		m.parseThroughput,
+		m.nameLength,
+		m.retryCount,
+		m.summaryTotal,
+		m.brokenToFailed,
+		m.orphanedFiles,
+		m.healthScore,
+		m.duplicateLabels,
+	}
+}
+
+func (m *reportMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range m.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+func (m *reportMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range m.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+// Строит набор метрик по снимку отчета
+func buildReportMetrics(snap *ReportSnapshot) *reportMetrics {
+	m := newReportMetrics()
+
+	if snap.Environment != nil {
+		updateEnvironmentMetrics(m, snap)
+		updateRunInfoMetrics(m, snap.Environment)
+	}
+	if snap.Executor != nil {
+		updateExecutorMetrics(m, snap.Executor)
+	}
+	updateFormatMetrics(m, snap.FormatVersion)
+	m.orphanedFiles.Set(float64(snap.OrphanedFiles))
+
+	// Без summary остальные части отчета не разбирались
+	if snap.Summary == nil {
+		return m
+	}
+	updateSummaryMetrics(m, snap.Summary)
+	m.filesFound.Set(float64(snap.TestCaseFiles))
+	if !snap.NewestModTime.IsZero() {
+		m.newestModTime.Set(float64(snap.NewestModTime.Unix()))
+		m.reportAge.Set(snap.ParsedAt.Sub(snap.NewestModTime).Seconds())
+	}
+
+	// Резкое падение при том же размере отчета указывает на деградацию I/O
+	if snap.ParseDuration > 0 {
+		m.parseThroughput.Set(float64(snap.TestCasesFound) / snap.ParseDuration.Seconds())
+	}
+
+	if snap.History != nil {
+		updateHistoryMetrics(m, snap.History)
+		updateBaselineMetrics(m, snap.Summary, snap.History)
+	}
+	if snap.Packages != nil {
+		updatePackageMetrics(m, snap.Packages)
+	}
+
+	// Метрики тест-кейсов собраны при чтении отчета и не меняются после публикации
+	if snap.tests != nil {
+		m.testCaseMetrics = snap.tests.finish()
+	}
+
+	// Если один шард завис, самый свежий старт перестает двигаться вперед
+	if !snap.LastTestStart.IsZero() {
+		m.sinceLastStart.Set(snap.ParsedAt.Sub(snap.LastTestStart).Seconds())
+	}
+	updateSuiteMetrics(m, snap.Suites)
+	m.filteredOut.Set(float64(snap.FilteredOut))
+	m.tooOld.Set(float64(snap.TooOld))
+	m.duplicateUUIDs.Set(float64(snap.DuplicateUUIDs))
+	m.statusChanges.Set(float64(snap.StatusChanges))
+
+	return m
+}
+
+// Опубликованный снимок и набор метрик, построенный по нему при первом скрейпе
+type publishedReport struct {
+	snapshot *ReportSnapshot
+	once     sync.Once
+	metrics  *reportMetrics
+
+	// С -reset-mode none/decay: прошлый набор и перенесенные из него серии,
+	// которых нет в текущем снимке
+	previous *publishedReport
+	carried  []prometheus.Metric
+}
+
+func (p *publishedReport) build() *reportMetrics {
+	p.once.Do(func() {
+		p.metrics = buildReportMetrics(p.snapshot)
+		if p.previous != nil {
+			p.carried = carryStaleSeries(p.metrics, p.previous)
+			p.previous = nil
+		}
+	})
+	return p.metrics
+}
+
+func (p *publishedReport) Describe(chan<- *prometheus.Desc) {}
+
+func (p *publishedReport) Collect(ch chan<- prometheus.Metric) {
+	p.build().Collect(ch)
+	for _, metric := range p.carried {
+		ch <- metric
+	}
+}
+
+// Серии прошлого набора, пропавшие из текущего: с none переносятся как есть,
+// с decay — с нулевым значением
+func carryStaleSeries(current *reportMetrics, previous *publishedReport) []prometheus.Metric {
+	present := make(map[string]bool)
+	for _, metric := range collectMetrics(current) {
+		if key, ok := seriesKey(metric); ok {
+			present[key] = true
+		}
+	}
+
+	var carried []prometheus.Metric
+	for _, metric := range collectMetrics(previous) {
+		key, ok := seriesKey(metric)
+		if !ok || present[key] {
+			continue
+		}
+		if cfg.resetMode == "decay" {
+			metric = zeroedMetric(metric)
+		}
+		carried = append(carried, metric)
+	}
+	return carried
+}
+
+func collectMetrics(c prometheus.Collector) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var metrics []prometheus.Metric
+	for metric := range ch {
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// Идентичность серии: описание метрики и значения меток
+func seriesKey(metric prometheus.Metric) (string, bool) {
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString(metric.Desc().String())
+	for _, label := range m.GetLabel() {
+		b.WriteString("\xff" + label.GetName() + "=" + label.GetValue())
+	}
+	return b.String(), true
+}
+
+// Серия с прежними метками и нулевым значением
+type zeroMetric struct {
+	desc   *prometheus.Desc
+	labels []*dto.LabelPair
+	kind   string
+	bounds []float64
+}
+
+func zeroedMetric(metric prometheus.Metric) prometheus.Metric {
+	var m dto.Metric
+	metric.Write(&m)
+
+	zero := zeroMetric{desc: metric.Desc(), labels: m.GetLabel()}
+	switch {
+	case m.Gauge != nil:
+		zero.kind = "gauge"
+	case m.Counter != nil:
+		zero.kind = "counter"
+	case m.Histogram != nil:
+		zero.kind = "histogram"
+		for _, bucket := range m.GetHistogram().GetBucket() {
+			zero.bounds = append(zero.bounds, bucket.GetUpperBound())
+		}
+	default:
+		zero.kind = "untyped"
+	}
+	return zero
+}
+
+func (z zeroMetric) Desc() *prometheus.Desc { return z.desc }
+
+func (z zeroMetric) Write(m *dto.Metric) error {
+	m.Label = z.labels
+	switch z.kind {
+	case "gauge":
+		m.Gauge = &dto.Gauge{Value: new(float64)}
+	case "counter":
+		m.Counter = &dto.Counter{Value: new(float64)}
+	case "histogram":
+		h := &dto.Histogram{SampleCount: new(uint64), SampleSum: new(float64)}
+		for i := range z.bounds {
+			h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: &z.bounds[i], CumulativeCount: new(uint64)})
+		}
+		m.Histogram = h
+	default:
+		m.Untyped = &dto.Untyped{Value: new(float64)}
+	}
+	return nil
+}
+
+// Отдает метрики последних полностью разобранных снимков: парсинг только подменяет
+// снимок, поэтому скрейп не видит частично заполненных метрик, а частота парсинга
+// не связана с частотой скрейпов. Проекты из манифеста получают метку project
+type snapshotCollector struct {
+	mu      sync.RWMutex
+	reports map[string]*publishedReport
+	// Ошибка последнего цикла по проекту для /status.json
+	errors map[string]string
+}
+
+func (c *snapshotCollector) publish(project string, snap *ReportSnapshot) {
+	// Данные, нужные только во время чтения, не должны жить вместе со снимком
+	snap.seenUUIDs, snap.testStatuses = nil, nil
+
+	c.mu.Lock()
+	p := &publishedReport{snapshot: snap}
+	if previous := c.reports[project]; previous != nil && cfg.resetMode != "full" {
+		// Набор, который так и не скрейпили, строится сейчас, чтобы цепочка
+		// прошлых снимков не росла между скрейпами
+		previous.build()
+		p.previous = previous
+	}
+	c.reports[project] = p
+	c.mu.Unlock()
+}
+
+// Готов, если у каждого проекта разобран summary хотя бы с minTests тестами;
+// для сырых allure-results достаточно успешного разбора контейнеров
+func (c *snapshotCollector) ready(minTests int) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.reports) == 0 {
+		return false
+	}
+	for _, p := range c.reports {
+		if p.snapshot.Raw {
+			continue
+		}
+		if p.snapshot.Summary == nil || p.snapshot.Summary.total() < minTests {
+			return false
+		}
+	}
+	return true
+}
+
+// Проекты, последний цикл которых не разобрал summary или пропустил больше maxErrors файлов
+func (c *snapshotCollector) failing(maxErrors int) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var projects []string
+	for project, p := range c.reports {
+		if (p.snapshot.Summary == nil && !p.snapshot.Raw) || p.snapshot.ParseErrors > maxErrors {
+			projects = append(projects, project)
+		}
+	}
+	sort.Strings(projects)
+	return projects
+}
+
+// Проекты, в последнем цикле которых не нашлось ни одного тест-кейса
+func (c *snapshotCollector) withoutTestCases() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var projects []string
+	for project, p := range c.reports {
+		if p.snapshot.Summary != nil && p.snapshot.TestCasesFound == 0 {
+			projects = append(projects, project)
+		}
+	}
+	sort.Strings(projects)
+	return projects
+}
+
+// Последние снимки всех проектов
+func (c *snapshotCollector) snapshots() map[string]*ReportSnapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	snaps := make(map[string]*ReportSnapshot, len(c.reports))
+	for project, p := range c.reports {
+		snaps[project] = p.snapshot
+	}
+	return snaps
+}
+
+func (c *snapshotCollector) snapshot(project string) *ReportSnapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if p, ok := c.reports[project]; ok {
+		return p.snapshot
+	}
+	return nil
+}
+
+// Убирает снимки проектов, которых больше нет в манифесте
+func (c *snapshotCollector) retain(projects map[string]*reportSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for project := range c.reports {
+		if _, ok := projects[project]; !ok {
+			delete(c.reports, project)
+		}
+	}
+	for project := range c.errors {
+		if _, ok := projects[project]; !ok {
+			delete(c.errors, project)
+		}
+	}
+}
+
+// Запоминает итог цикла проекта; успешный цикл стирает прошлую ошибку
+func (c *snapshotCollector) recordError(project string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		delete(c.errors, project)
+		return
+	}
+	c.errors[project] = err.Error()
+}
+
+func (c *snapshotCollector) lastErrors() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	errs := make(map[string]string, len(c.errors))
+	for project, err := range c.errors {
+		errs[project] = err
+	}
+	return errs
+}
+
+// Набор проектов меняется при перечитывании манифеста, поэтому коллектор
+// не описывает метрики заранее (unchecked collector)
+func (c *snapshotCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for project, p := range c.reports {
+		if project == "" {
+			p.Collect(ch)
+			continue
+		}
+		prometheus.WrapCollectorWith(prometheus.Labels{"project": project}, p).Collect(ch)
+	}
+}
+
+func init() {
+	// Инициализация логгера
+	var err error
+	logger, err = zap.NewProduction()
+	if err != nil {
+		fmt.Printf("Failed to init logger: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Регистрация метрик
+	prometheus.MustRegister(reportCollector)
+	prometheus.MustRegister(exporterMetrics.parseQueueDepth)
+	prometheus.MustRegister(exporterMetrics.filesTooLarge)
+	prometheus.MustRegister(exporterMetrics.parseAllocBytes)
+	prometheus.MustRegister(exporterMetrics.readRetries)
+	prometheus.MustRegister(exporterMetrics.sourceDuration)
+	prometheus.MustRegister(exporterMetrics.sourceErrors)
+	prometheus.MustRegister(exporterMetrics.consecutiveFailures)
+}
+
+// Файл отчета превышает -max-file-size
+var errFileTooLarge = errors.New("file exceeds max size")
+
+// Ошибки разбора файлов отчета; исходная ошибка доступна через errors.Unwrap
+type (
+	ErrFileNotFound struct {
+		File string
+		Err  error
+	}
+
+	ErrMalformedJSON struct {
+		File string
+		Err  error
+	}
+
+	ErrMissingField struct {
+		File  string
+		Field string
+	}
+)
+
+func (e *ErrFileNotFound) Error() string {
+	return fmt.Sprintf("file not found: %s: %v", e.File, e.Err)
+}
+
+func (e *ErrFileNotFound) Unwrap() error { return e.Err }
+
+func (e *ErrMalformedJSON) Error() string {
+	return fmt.Sprintf("malformed json in %s: %v", e.File, e.Err)
+}
+
+func (e *ErrMalformedJSON) Unwrap() error { return e.Err }
+
+func (e *ErrMissingField) Error() string {
+	return fmt.Sprintf("%s has no %q field", e.File, e.Field)
+}
+
+// Отсутствующий файл получает отдельный тип, остальные ошибки чтения остаются ошибками ввода-вывода
+func readError(name string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return &ErrFileNotFound{File: name, Err: err}
+	}
+	return fmt.Errorf("read file: %w", err)
+}
+
+func main() {
+	defer logger.Sync()
+
+	if err := parseFlags(); err != nil {
+		logger.Fatal("Invalid flags", zap.Error(err))
+	}
+
+	if cfg.insecure {
+		logger.Warn("TLS certificate verification of report sources is DISABLED by -insecure; never use it in production")
+	}
+
+	if cfg.skipUnchanged && cfg.since > 0 {
+		logger.Warn("-skip-unchanged has no effect with -since: the window moves every cycle, so the report is always parsed")
+	}
+
+	registerConfigInfo()
+
+	// Профилирование парсинга добавляет накладные расходы и включается отдельно
+	if cfg.profileParse {
+		exporterMetrics.testcaseParse = prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "allure_testcase_parse_seconds",
+				Help:    "Per-file test case read and unmarshal duration",
+				Buckets: cfg.parseBuckets,
+			},
+		)
+		prometheus.MustRegister(exporterMetrics.testcaseParse)
+	}
+
+	// Накопительный счетчик для increase() в дополнение к gauge текущего отчета
+	if cfg.emitCounters {
+		exporterMetrics.testsProcessed = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "allure_tests_processed_total",
+				Help: "Tests counted in parsed summaries by status, cumulative across cycles",
+			},
+			[]string{"status"},
+		)
+		prometheus.MustRegister(exporterMetrics.testsProcessed)
+	}
+
+	var source *reportSource
+	if cfg.manifest == "" {
+		if flag.NArg() < 1 {
+			logger.Fatal("Usage: ./allure-parser [flags] <path-to-allure-results> [<port>]")
+		}
+
+		// Позиционный порт оставлен для обратной совместимости
+		if flag.NArg() > 1 {
+			cfg.port = flag.Arg(1)
+		}
+
+		// Тест-кейсы из stdin разбираются один раз, после чего процесс завершается
+		if flag.Arg(0) == stdinPath {
+			runStdin(os.Stdin, os.Stdout)
+			if cfg.exitOnFailures >= 0 {
+				code := checkFailures(os.Stdout)
+				logger.Sync()
+				os.Exit(code)
+			}
+			return
+		}
+
+		// Источник отчета: локальная директория или s3://bucket/prefix
+		fsys, err := openSource(flag.Arg(0))
+		if err != nil {
+			logger.Fatal("Failed to open report source", zap.Error(err))
+		}
+		source = &reportSource{project: cfg.project, location: flag.Arg(0), fsys: fsys}
+	} else if flag.NArg() > 0 {
+		cfg.port = flag.Arg(0)
+	}
+
+	if cfg.historyPath != "" {
+		var err error
+		if historyFS, historyFile, err = openHistory(cfg.historyPath); err != nil {
+			logger.Fatal("Failed to open history source", zap.Error(err))
+		}
+	}
+
+	// Проверка качества в CI: один парсинг и код возврата по числу падений
+	if cfg.exitOnFailures >= 0 {
+		runParser(source)
+		code := checkFailures(os.Stdout)
+		logger.Sync()
+		os.Exit(code)
+	}
+
+	// С -output метрики только пишутся в файл, HTTP-сервер не нужен
+	if cfg.output != "" {
+		runParser(source)
+		return
+	}
+
+	// Запуск парсера
+	go runParser(source)
+
+	// HTTP серверы
+	servers, err := newServers()
+	if err != nil {
+		logger.Fatal("Listen failed", zap.Error(err))
+	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		shutdownOnSignal(servers)
+		close(shutdownDone)
+	}()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s httpServer) {
+			defer wg.Done()
+			logger.Info("Starting server", zap.String("addr", s.listener.Addr().String()))
+			if err := s.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+				logger.Fatal("Server failed", zap.Error(err))
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	// Serve возвращается сразу после начала остановки; ждем завершения активных запросов
+	<-shutdownDone
+}
+
+// Итог проверки одного проекта; с -output-format json печатается как есть
+type checkResult struct {
+	Project        string            `json:"project,omitempty"`
+	Verdict        string            `json:"verdict"`
+	Passed         int               `json:"passed"`
+	Failed         int               `json:"failed"`
+	Broken         int               `json:"broken"`
+	Skipped        int               `json:"skipped"`
+	Allowed        int               `json:"allowed"`
+	TestCaseFiles  int               `json:"test_case_files"`
+	TestCasesFound int               `json:"test_cases_found"`
+	ParseErrors    int               `json:"parse_errors"`
+	OrphanedFiles  int               `json:"orphaned_files,omitempty"`
+	Stages         map[string]string `json:"stages,omitempty"`
+	Errors         []string          `json:"errors,omitempty"`
+	Warnings       []string          `json:"warnings,omitempty"`
+}
+
+// Без этих стадий метрики отчета не строятся, сбои остальных — предупреждения
+var requiredStages = map[string]bool{"summary": true, "test_cases": true}
+
+func newCheckResult(project string, snap *ReportSnapshot) checkResult {
+	result := checkResult{
+		Project:        project,
+		Allowed:        cfg.exitOnFailures,
+		TestCaseFiles:  snap.TestCaseFiles,
+		TestCasesFound: snap.TestCasesFound,
+		ParseErrors:    snap.ParseErrors,
+		OrphanedFiles:  snap.OrphanedFiles,
+		Stages:         snap.Stages,
+	}
+
+	stages := make([]string, 0, len(snap.Stages))
+	for stage := range snap.Stages {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		if outcome := snap.Stages[stage]; outcome != "ok" {
+			message := stage + ": " + outcome
+			if requiredStages[stage] {
+				result.Errors = append(result.Errors, message)
+			} else {
+				result.Warnings = append(result.Warnings, message)
+			}
+		}
+	}
+	if snap.ParseErrors > 0 {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("%d test cases could not be parsed", snap.ParseErrors))
+	}
+	if snap.DuplicateUUIDs > 0 {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("%d duplicate test case uuids", snap.DuplicateUUIDs))
+	}
+
+	// В сырых allure-results нет статусов для проверки, но это не сбой разбора
+	if snap.Raw {
+		result.Verdict = "RAW"
+		if snap.OrphanedFiles > 0 {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%d containers reference missing results", snap.OrphanedFiles))
+		}
+		return result
+	}
+	if snap.Summary == nil {
+		result.Verdict = "NO_SUMMARY"
+		return result
+	}
+	stat := snap.Summary.Statistic
+	result.Passed, result.Failed, result.Broken, result.Skipped = stat.Passed, stat.Failed, stat.Broken, stat.Skipped
+	result.Verdict = "OK"
+	if stat.Failed+stat.Broken > cfg.exitOnFailures {
+		result.Verdict = "FAIL"
+	}
+	return result
+}
+
+// Печатает сводку по проектам в w и возвращает код выхода: 1 — падений больше
+// -exit-on-failures, 2 — summary не разобран
+func checkFailures(w io.Writer) int {
+	reports := reportCollector.snapshots()
+
+	projects := make([]string, 0, len(reports))
+	for project := range reports {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+
+	code := 0
+	if len(reports) == 0 {
+		code = 2
+	}
+	results := make([]checkResult, 0, len(projects))
+	for _, project := range projects {
+		result := newCheckResult(project, reports[project])
+		switch {
+		case result.Verdict == "NO_SUMMARY":
+			code = 2
+		case result.Verdict == "FAIL" && code == 0:
+			code = 1
+		}
+		results = append(results, result)
+	}
+
+	if cfg.outputFormat == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			ExitCode int           `json:"exit_code"`
+			Projects []checkResult `json:"projects"`
+		}{code, results})
+		return code
+	}
+
+	if len(results) == 0 {
+		fmt.Fprintln(w, "No report parsed")
+	}
+	for _, result := range results {
+		prefix := ""
+		if result.Project != "" {
+			prefix = result.Project + ": "
+		}
+		switch result.Verdict {
+		case "NO_SUMMARY":
+			fmt.Fprintf(w, "%sno summary parsed\n", prefix)
+			continue
+		case "RAW":
+			fmt.Fprintf(w, "%sRAW: raw allure-results, failures not checked (orphaned containers %d)\n", prefix, result.OrphanedFiles)
+			continue
+		}
+		fmt.Fprintf(w, "%s%s: passed=%d failed=%d broken=%d skipped=%d (failed+broken %d, allowed %d)\n",
+			prefix, result.Verdict, result.Passed, result.Failed, result.Broken, result.Skipped,
+			result.Failed+result.Broken, result.Allowed)
+	}
+	return code
+}
+
+// HTTP-сервер вместе со слушателем, на котором он запускается
+type httpServer struct {
+	*http.Server
+	listener net.Listener
+}
+
+// Итоговые настройки экземпляра в allure_parser_config, чтобы видеть расхождения между развертываниями
+func registerConfigInfo() {
+	settings := prometheus.Labels{
+		"interval":              cfg.interval.String(),
+		"format":                cfg.format,
+		"project":               cfg.project,
+		"manifest":              cfg.manifest,
+		"path_prefix":           cfg.pathPrefix,
+		"per_test_statuses":     cfg.perTestStatusList,
+		"min_per_test_severity": cfg.minPerTestSeverity,
+		"since":                 cfg.since.String(),
+		"source_timeout":        cfg.sourceTimeout.String(),
+		"parse_workers":         strconv.Itoa(cfg.parseWorkers),
+		"max_file_size":         strconv.FormatInt(cfg.maxFileSize, 10),
+		"reset_mode":            cfg.resetMode,
+		"skip_unchanged":        strconv.FormatBool(cfg.skipUnchanged),
+		"require_complete":      strconv.FormatBool(cfg.requireComplete),
+		"normalize_names":       strconv.FormatBool(cfg.normalizeNames),
+		"recursive":             strconv.FormatBool(cfg.recursive),
+		"insecure":              strconv.FormatBool(cfg.insecure),
+	}
+	for name, value := range settings {
+		settings[name] = configLabelValue(value)
+	}
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "allure_parser_config",
+		Help:        "Effective exporter settings as labels, always 1",
+		ConstLabels: settings,
+	})
+	gauge.Set(1)
+	prometheus.MustRegister(gauge)
+}
+
+// Длина значения метки настроек; длиннее обрезается
+const maxConfigLabelLen = 128
+
+// Значение флага может быть любым: битый UTF-8 сломал бы /metrics целиком,
+// а длинные списки раздувают каждую выборку
+func configLabelValue(value string) string {
+	value = strings.ToValidUTF8(strings.TrimSpace(value), "?")
+	if runes := []rune(value); len(runes) > maxConfigLabelLen {
+		value = string(runes[:maxConfigLabelLen])
+	}
+	return value
+}
+
+// Регистрирует эндпоинты: метрики отдельно от служебных
+func registerHandlers(metricsMux, adminMux *http.ServeMux) {
+	// То же, что promhttp.Handler(): ответ сжимается gzip по Accept-Encoding
+	prefix := cfg.pathPrefix
+	metricsMux.Handle(prefix+"/metrics", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{}),
+	))
+	metricsMux.HandleFunc(prefix+"/dump", dumpMetrics)
+	metricsMux.HandleFunc(prefix+"/status.json", statusJSON)
+
+	adminMux.HandleFunc(prefix+"/health", healthCheck)
+	adminMux.HandleFunc(prefix+"/ready", readyCheck)
+	if cfg.maxHealthPause > 0 {
+		adminMux.HandleFunc(prefix+"/health/pause", pauseHealth)
+	}
+	if cfg.snapshotEndpoint {
+		adminMux.HandleFunc(prefix+"/debug/snapshot", snapshotJSON)
+	}
+
+	// Стартовая страница перечисляет эндпоинты своего сервера
+	metricsPaths := []string{prefix + "/metrics", prefix + "/dump", prefix + "/status.json"}
+	adminPaths := []string{prefix + "/health", prefix + "/ready"}
+	if cfg.maxHealthPause > 0 {
+		adminPaths = append(adminPaths, prefix+"/health/pause")
+	}
+	if cfg.snapshotEndpoint {
+		adminPaths = append(adminPaths, prefix+"/debug/snapshot")
+	}
+	if metricsMux == adminMux {
+		registerIndex(metricsMux, append(metricsPaths, adminPaths...))
+		return
+	}
+	registerIndex(metricsMux, metricsPaths)
+	registerIndex(adminMux, adminPaths)
+}
+
+// Браузер, открывший корень экспортера, видит список эндпоинтов вместо 404,
+// а запрос иконки не засоряет логи. Остальные пути под корнем — по-прежнему 404
+func registerIndex(mux *http.ServeMux, paths []string) {
+	root := cfg.pathPrefix + "/"
+	mux.HandleFunc(root, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != root {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<!DOCTYPE html>\n<html><head><title>Allure exporter</title></head><body>\n<h1>Allure exporter</h1>\n<ul>\n")
+		for _, p := range paths {
+			fmt.Fprintf(w, "<li><a href=\"%s\">%[1]s</a></li>\n", html.EscapeString(p))
+		}
+		fmt.Fprint(w, "</ul>\n</body></html>\n")
+	})
+	mux.HandleFunc(cfg.pathPrefix+"/favicon.ico", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// С -metrics-addr и -admin-addr поднимаются два сервера, иначе все эндпоинты на одном
+func newServers() ([]httpServer, error) {
+	if cfg.metricsAddr != "" && cfg.adminAddr != "" {
+		metricsMux, adminMux := http.NewServeMux(), http.NewServeMux()
+		registerHandlers(metricsMux, adminMux)
+
+		metricsListener, err := net.Listen("tcp", cfg.metricsAddr)
+		if err != nil {
+			return nil, fmt.Errorf("listen metrics addr: %w", err)
+		}
+		adminListener, err := net.Listen("tcp", cfg.adminAddr)
+		if err != nil {
+			metricsListener.Close()
+			return nil, fmt.Errorf("listen admin addr: %w", err)
+		}
+		return []httpServer{
+			{Server: &http.Server{Handler: metricsMux}, listener: metricsListener},
+			{Server: &http.Server{Handler: adminMux}, listener: adminListener},
+		}, nil
+	}
+
+	mux := http.NewServeMux()
+	registerHandlers(mux, mux)
+
+	listener, err := newListener()
+	if err != nil {
+		return nil, err
+	}
+	return []httpServer{{Server: &http.Server{Handler: mux}, listener: listener}}, nil
+}
+
+// Создает TCP-слушатель на порту или unix-сокет, если задан -socket.
+// Единственный из -metrics-addr и -admin-addr заменяет порт
+func newListener() (net.Listener, error) {
+	// Оба адреса сразу сюда не доходят: тогда newServers поднимает два сервера
+	if cfg.metricsAddr != "" {
+		return net.Listen("tcp", cfg.metricsAddr)
+	}
+	if cfg.adminAddr != "" {
+		return net.Listen("tcp", cfg.adminAddr)
+	}
+	if cfg.socket == "" {
+		return net.Listen("tcp", ":"+cfg.port)
+	}
+
+	// Убираем сокет, оставшийся от предыдущего запуска
+	if err := os.Remove(cfg.socket); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", cfg.socket)
+	if err != nil {
+		return nil, fmt.Errorf("listen unix socket: %w", err)
+	}
+	return listener, nil
+}
+
+// Останавливает серверы по SIGINT/SIGTERM; unix-сокет удаляется при закрытии слушателя
+func shutdownOnSignal(servers []httpServer) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+
+	logger.Info("Shutting down", zap.String("signal", sig.String()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Warn("Graceful shutdown failed", zap.Error(err))
+		}
+	}
+}
+
+// Разбор флагов командной строки
+func parseFlags() error {
+	flag.StringVar(&cfg.port, "port", "8080", "TCP port for the HTTP server")
+	flag.StringVar(&cfg.socket, "socket", "", "Unix socket path to listen on instead of -port")
+	flag.BoolVar(&cfg.normalizeNames, "normalize-names", false, "Strip test parameters from names used as metric labels")
+	flag.StringVar(&cfg.normalizePattern, "normalize-pattern", `\[.*\]`, "Regex removed from test names when -normalize-names is set")
+	flag.StringVar(&cfg.failureThreshold, "failure-threshold", "0", "Max failed+broken tests for allure_suite_healthy: absolute count (5) or percent of total (2.5%)")
+	flag.StringVar(&cfg.perTestStatusList, "per-test-statuses", "", "Comma-separated statuses that get per-test series, e.g. failed,broken (default: all)")
+	flag.Int64Var(&cfg.maxFileSize, "max-file-size", 100<<20, "Skip report files larger than this many bytes (0 disables the limit)")
+	flag.IntVar(&cfg.baselineBuilds, "baseline-builds", 5, "Number of recent history builds averaged for allure_failures_vs_baseline")
+	flag.StringVar(&cfg.labelAllowList, "label-allow", "", "Allowed values per label type for allure_tests_by_label, e.g. tag=smoke|regression,epic=auth; others become \"other\"")
+	flag.IntVar(&cfg.labelMaxValues, "label-max-values", 0, "Max distinct values per label type in allure_tests_by_label; overflow becomes \"other\" (0 disables the cap)")
+	flag.BoolVar(&cfg.profileParse, "profile-parse", false, "Observe per-file test case parse duration into allure_testcase_parse_seconds")
+	flag.StringVar(&cfg.durationBucketList, "duration-buckets", "0.1,0.5,1,5,10,30,60,120,300,600", "Comma-separated bucket bounds in seconds for allure_tests_duration_seconds")
+	flag.StringVar(&cfg.parseBucketList, "parse-buckets", "0.0005,0.001,0.0025,0.005,0.01,0.025,0.05,0.1,0.25,0.5,1", "Comma-separated bucket bounds in seconds for allure_testcase_parse_seconds")
+	flag.BoolVar(&cfg.skipUnchanged, "skip-unchanged", false, "Skip rebuilding metrics when the report has not changed since the last successful cycle")
+	flag.StringVar(&cfg.includeSuitePrefix, "include-suite-prefix", "", "Only export test cases whose suite label starts with this prefix")
+	flag.StringVar(&cfg.statusValueList, "status-value", "passed=1,failed=0,broken=0,skipped=0", "Value of allure_test_status per status; unlisted statuses get 0")
+	flag.StringVar(&cfg.manifest, "manifest", "", "JSON manifest [{\"name\":...,\"path\":...}] of report sources exported with a project label")
+	flag.BoolVar(&cfg.recursive, "recursive", false, "Find test case *.json files at any depth under data/test-cases")
+	flag.StringVar(&cfg.slaList, "sla", "", "Max test duration per severity, e.g. blocker=30s,critical=60s")
+	flag.StringVar(&cfg.format, "format", "allure2", "Report format: allure2 (generated report JSON) or allure1 (*-testsuite.xml results)")
+	flag.DurationVar(&cfg.cacheTTL, "cache-ttl", 0, "Cache S3 report objects in memory; within the TTL they are not re-fetched, after it they are revalidated by ETag (0 disables the cache)")
+	flag.DurationVar(&cfg.interval, "interval", 30*time.Second, "Interval between parses (0 parses once)")
+	flag.StringVar(&cfg.output, "output", "", "Write metrics in Prometheus text format to this file after each parse instead of serving HTTP")
+	flag.StringVar(&cfg.timeoutPatternList, "timeout-patterns", "timeout,timed out", "Comma-separated status message substrings (case-insensitive) marking a broken test as timed out")
+	flag.IntVar(&cfg.minTestsReady, "min-tests-ready", 1, "Tests the parsed summary must report before /ready succeeds (0 only requires a summary)")
+	flag.BoolVar(&cfg.unhealthyOnErrors, "unhealthy-on-errors", false, "Fail /health when the last cycle could not parse the summary or skipped more than -max-parse-errors broken test case files")
+	flag.IntVar(&cfg.maxParseErrors, "max-parse-errors", 0, "Broken test case files tolerated per cycle with -unhealthy-on-errors")
+	flag.IntVar(&cfg.parseWorkers, "parse-workers", runtime.NumCPU(), "Test case files read and parsed concurrently")
+	flag.IntVar(&cfg.readRetries, "read-retries", 0, "Retries of a report file read after a transient error (missing and oversized files are not retried)")
+	flag.StringVar(&cfg.statusAliasList, "status-alias", "", "Map framework statuses onto Allure ones after lowercasing, e.g. success=passed,error=broken")
+	flag.StringVar(&cfg.metricsAddr, "metrics-addr", "", "Address for /metrics and /dump; with -admin-addr the endpoints are split between two servers")
+	flag.StringVar(&cfg.adminAddr, "admin-addr", "", "Address for /health and /ready, e.g. 127.0.0.1:9090")
+	flag.StringVar(&cfg.screenshotTypeList, "screenshot-types", "image/png", "Comma-separated attachment MIME types counted as screenshots for allure_failed_without_screenshot_total")
+	flag.IntVar(&cfg.exitOnFailures, "exit-on-failures", -1, "With -interval 0, print a summary and exit 1 when failed+broken tests exceed this count (-1 disables)")
+	flag.StringVar(&cfg.historyPath, "history-path", "", "External history-trend.json (local path or s3://bucket/key) read instead of widgets/history-trend.json")
+	flag.StringVar(&cfg.envLabel, "env-label", "host", "Test label whose value becomes the env label of per-test metrics and allure_tests_by_env_total")
+	flag.BoolVar(&cfg.allLabels, "all-labels", false, "Export every test label in allure_tests_by_label, not only epic/feature/story/severity/owner/layer")
+	flag.BoolVar(&cfg.requireComplete, "require-complete", false, "Keep the previous cycle's metrics while the summary total and the number of test cases disagree by more than -complete-tolerance")
+	flag.Float64Var(&cfg.completeTolerance, "complete-tolerance", 0, "Allowed relative difference between the summary total and the test cases found with -require-complete, e.g. 0.05")
+	flag.StringVar(&cfg.unknownLabelValue, "unknown-label-value", "unknown", "Value substituted for a missing test label (suite, severity, layer, -env-label)")
+	flag.BoolVar(&cfg.emitCounters, "emit-counters", false, "Also add every parsed summary to the cumulative allure_tests_processed_total{status} counter")
+	flag.DurationVar(&cfg.maxHealthPause, "max-health-pause", 0, "Longest staleness pause accepted by POST /health/pause?duration=...; 0 disables the endpoint")
+	flag.StringVar(&cfg.outputFormat, "output-format", "text", "Format of the -exit-on-failures report: text or json")
+	flag.DurationVar(&cfg.since, "since", 0, "Export only test cases started within this window before the parse, e.g. 24h; older ones are counted in allure_tests_too_old (0 disables)")
+	flag.StringVar(&cfg.pathPrefix, "path-prefix", "", "Serve every endpoint under this path, e.g. /allure-exporter for a path-based reverse proxy")
+	flag.StringVar(&cfg.project, "project", "", "Project label for the metrics of a single report, so several exporters are told apart the same way as manifest projects")
+	flag.DurationVar(&cfg.sourceTimeout, "source-timeout", 0, "Stop waiting for a report source after this long so the other sources of the cycle are not delayed (0 waits indefinitely)")
+	flag.StringVar(&cfg.resetMode, "reset-mode", "full", "Series missing from a new report: full drops them, none keeps their last value, decay keeps them at zero")
+	flag.StringVar(&cfg.caCert, "ca-cert", "", "PEM bundle of extra CA certificates trusted by S3 sources, e.g. for an internal PKI")
+	flag.BoolVar(&cfg.insecure, "insecure", false, "Skip TLS certificate verification of S3 sources; for development only")
+	flag.StringVar(&cfg.weightList, "weight", "passed=1,failed=-2,broken=-1", "Status weights of allure_suite_health_score; unlisted statuses weigh 0")
+	flag.StringVar(&cfg.minPerTestSeverity, "min-per-test-severity", "", "Lowest severity that gets per-test series, e.g. critical; aggregates still count every test (default: all)")
+	flag.BoolVar(&cfg.snapshotEndpoint, "snapshot-endpoint", false, "Serve the parsed report snapshot as JSON at /debug/snapshot for integration tests; not for production")
+	flag.Parse()
+
+	if cfg.normalizeNames {
+		re, err := regexp.Compile(cfg.normalizePattern)
+		if err != nil {
+			return fmt.Errorf("normalize pattern: %w", err)
+		}
+		cfg.nameNormalizer = re
+	}
+
+	if cfg.format != "allure2" && cfg.format != "allure1" {
+		return fmt.Errorf("unknown format %q, want allure2 or allure1", cfg.format)
+	}
+
+	if cfg.interval < 0 {
+		return fmt.Errorf("interval must not be negative, got %s", cfg.interval)
+	}
+
+	if cfg.outputFormat != "text" && cfg.outputFormat != "json" {
+		return fmt.Errorf("unknown output format %q, want text or json", cfg.outputFormat)
+	}
+
+	if cfg.exitOnFailures >= 0 && cfg.interval != 0 {
+		return fmt.Errorf("exit on failures requires -interval 0")
+	}
+
+	if cfg.completeTolerance < 0 {
+		return fmt.Errorf("complete tolerance must not be negative, got %g", cfg.completeTolerance)
+	}
+
+	// "allure-exporter/", "/allure-exporter/" и "/allure-exporter" дают один префикс
+	if cfg.pathPrefix != "" {
+		cfg.pathPrefix = strings.TrimSuffix(path.Clean("/"+cfg.pathPrefix), "/")
+	}
+
+	if cfg.project != "" && cfg.manifest != "" {
+		return fmt.Errorf("project is taken from the manifest entries, -project applies to a single report")
+	}
+
+	switch cfg.resetMode {
+	case "full", "none", "decay":
+	default:
+		return fmt.Errorf("unknown reset mode %q, want full, none or decay", cfg.resetMode)
+	}
+
+	// Опечатка в severity молча превратилась бы в normal
+	cfg.minPerTestSeverity = strings.ToLower(strings.TrimSpace(cfg.minPerTestSeverity))
+	switch cfg.minPerTestSeverity {
+	case "", "blocker", "critical", "normal", "minor", "trivial":
+	default:
+		return fmt.Errorf("unknown min per-test severity %q, want blocker, critical, normal, minor or trivial", cfg.minPerTestSeverity)
+	}
+
+	if cfg.sourceTimeout < 0 {
+		return fmt.Errorf("source timeout must not be negative, got %s", cfg.sourceTimeout)
+	}
+
+	if cfg.since < 0 {
+		return fmt.Errorf("since must not be negative, got %s", cfg.since)
+	}
+
+	if cfg.parseWorkers < 1 {
+		return fmt.Errorf("parse workers must be positive, got %d", cfg.parseWorkers)
+	}
+
+	if cfg.baselineBuilds < 1 {
+		return fmt.Errorf("baseline builds must be positive, got %d", cfg.baselineBuilds)
+	}
+
+	value, percent, err := parseThreshold(cfg.failureThreshold)
+	if err != nil {
+		return fmt.Errorf("failure threshold: %w", err)
+	}
+	cfg.failureThresholdValue, cfg.failureThresholdPercent = value, percent
+
+	if cfg.durationBuckets, err = parseBuckets(cfg.durationBucketList); err != nil {
+		return fmt.Errorf("duration buckets: %w", err)
+	}
+	if cfg.parseBuckets, err = parseBuckets(cfg.parseBucketList); err != nil {
+		return fmt.Errorf("parse buckets: %w", err)
+	}
+
+	allow, err := parseKeyValues(cfg.labelAllowList)
+	if err != nil {
+		return fmt.Errorf("label allow-list: %w", err)
+	}
+	if len(allow) > 0 {
+		cfg.labelAllow = make(map[string]map[string]bool, len(allow))
+		for labelType, values := range allow {
+			labelType = normalizeLabelName(labelType)
+			cfg.labelAllow[labelType] = make(map[string]bool)
+			for _, value := range strings.Split(values, "|") {
+				cfg.labelAllow[labelType][strings.TrimSpace(value)] = true
+			}
+		}
+	}
+
+	slas, err := parseKeyValues(cfg.slaList)
+	if err != nil {
+		return fmt.Errorf("sla: %w", err)
+	}
+	cfg.sla = make(map[string]time.Duration, len(slas))
+	for severity, raw := range slas {
+		limit, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("sla for %q: %w", severity, err)
+		}
+		cfg.sla[strings.ToLower(severity)] = limit
+	}
+
+	statusValues, err := parseKeyValues(cfg.statusValueList)
+	if err != nil {
+		return fmt.Errorf("status values: %w", err)
+	}
+	cfg.statusValues = make(map[string]float64, len(statusValues))
+	for status, raw := range statusValues {
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("status value for %q: %w", status, err)
+		}
+		cfg.statusValues[strings.ToLower(status)] = value
+	}
+
+	weights, err := parseKeyValues(cfg.weightList)
+	if err != nil {
+		return fmt.Errorf("weights: %w", err)
+	}
+	cfg.weights = make(map[string]float64, len(weights))
+	var minWeight, maxWeight float64
+	for status, raw := range weights {
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("weight for %q: %w", status, err)
+		}
+		cfg.weights[strings.ToLower(status)] = value
+		minWeight, maxWeight = min(minWeight, value), max(maxWeight, value)
+	}
+	if minWeight == maxWeight {
+		return fmt.Errorf("weights must not all be zero")
+	}
+
+	aliases, err := parseKeyValues(cfg.statusAliasList)
+	if err != nil {
+		return fmt.Errorf("status aliases: %w", err)
+	}
+	cfg.statusAliases = make(map[string]string, len(aliases))
+	for from, to := range aliases {
+		cfg.statusAliases[strings.ToLower(from)] = strings.ToLower(to)
+	}
+
+	cfg.screenshotTypes = make(map[string]bool)
+	for _, mimeType := range splitList(cfg.screenshotTypeList) {
+		cfg.screenshotTypes[strings.ToLower(mimeType)] = true
+	}
+
+	for _, pattern := range splitList(cfg.timeoutPatternList) {
+		cfg.timeoutPatterns = append(cfg.timeoutPatterns, strings.ToLower(pattern))
+	}
+
+	if statuses := splitList(cfg.perTestStatusList); len(statuses) > 0 {
+		cfg.perTestStatuses = make(map[string]bool, len(statuses))
+		for _, status := range statuses {
+			cfg.perTestStatuses[strings.ToLower(status)] = true
+		}
+	}
+
+	return nil
+}
+
+// Разбирает границы бакетов гистограммы; они должны строго возрастать
+func parseBuckets(raw string) ([]float64, error) {
+	items := splitList(raw)
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no buckets given")
+	}
+
+	buckets := make([]float64, 0, len(items))
+	for i, item := range items {
+		bound, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse bound %q: %w", item, err)
+		}
+		if i > 0 && bound <= buckets[i-1] {
+			return nil, fmt.Errorf("bounds must be sorted ascending, %v follows %v", bound, buckets[i-1])
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+}
+
+// Разбирает пары вида "key=value,key2=value2"
+func parseKeyValues(raw string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, item := range splitList(raw) {
+		key, value, ok := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid pair %q, expected key=value", item)
+		}
+		pairs[key] = strings.TrimSpace(value)
+	}
+	return pairs, nil
+}
+
+// Разбивает список через запятую, отбрасывая пустые элементы
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Разбирает порог вида "5" (абсолютное значение) или "2.5%" (процент)
+func parseThreshold(raw string) (float64, bool, error) {
+	raw = strings.TrimSpace(raw)
+	percent := strings.HasSuffix(raw, "%")
+	value, err := strconv.ParseFloat(strings.TrimSuffix(raw, "%"), 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("parse %q: %w", raw, err)
+	}
+	if value < 0 || (percent && value > 100) {
+		return 0, false, fmt.Errorf("value %q out of range", raw)
+	}
+	return value, percent, nil
+}
+
+// Открывает источник отчета; все источники читаются через единый интерфейс fs.FS
+func openSource(location string) (fs.FS, error) {
+	if strings.HasPrefix(location, "s3://") {
+		return newS3FS(context.Background(), location)
+	}
+	return os.DirFS(location), nil
+}
+
+// Открывает директорию файла истории тем же способом, что и источник отчета
+func openHistory(location string) (fs.FS, string, error) {
+	dir, name := ".", location
+	if i := strings.LastIndex(location, "/"); i >= 0 {
+		dir, name = location[:i], location[i+1:]
+		if dir == "" {
+			dir = "/"
+		}
+	}
+	if name == "" {
+		return nil, "", fmt.Errorf("history path %q has no file name", location)
+	}
+
+	fsys, err := openSource(dir)
+	return fsys, name, err
+}
+
+// Источники текущего цикла: единственный путь или проекты из манифеста.
+// Вызывается под parseMu
+func currentSources(single *reportSource) ([]*reportSource, error) {
+	if single != nil {
+		return []*reportSource{single}, nil
+	}
+
+	// Манифест перечитывается каждый цикл, чтобы подхватывать изменения без перезапуска
+	entries, err := loadManifest(cfg.manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make([]*reportSource, 0, len(entries))
+	current := make(map[string]*reportSource, len(entries))
+	for _, entry := range entries {
+		src, ok := manifestSources[entry.Name]
+		if !ok || src.location != entry.Path {
+			fsys, err := openSource(entry.Path)
+			if err != nil {
+				logger.Warn("Failed to open project source",
+					zap.String("project", entry.Name),
+					zap.Error(err))
+				continue
+			}
+			src = &reportSource{project: entry.Name, location: entry.Path, fsys: fsys}
+		}
+		current[entry.Name] = src
+		sources = append(sources, src)
+	}
+
+	manifestSources = current
+	reportCollector.retain(current)
+	return sources, nil
+}
+
+func loadManifest(name string) ([]manifestEntry, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("manifest json unmarshal: %w", err)
+	}
+
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if entry.Name == "" || entry.Path == "" {
+			return nil, fmt.Errorf("manifest entry %+v needs both name and path", entry)
+		}
+		if seen[entry.Name] {
+			return nil, fmt.Errorf("duplicate project %q in manifest", entry.Name)
+		}
+		seen[entry.Name] = true
+	}
+
+	return entries, nil
+}
+
+// Парсит все источники; ошибка одного проекта не мешает остальным
+func parseSources(single *reportSource) error {
+	// Блокировка берется до чтения манифеста: currentSources меняет manifestSources
+	// и удаляет из коллектора снимки проектов, которых больше нет
+	parseMu.Lock()
+	defer parseMu.Unlock()
+
+	sources, err := currentSources(single)
+	if err != nil {
+		return err
+	}
+
+	// Источники разбираются параллельно: медленный или сломанный не задерживает остальные
+	var (
+		wg     sync.WaitGroup
+		errsMu sync.Mutex
+		errs   []error
+	)
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src *reportSource) {
+			defer wg.Done()
+			err := parseSource(src)
+			reportCollector.recordError(src.project, err)
+			if err != nil {
+				exporterMetrics.sourceErrors.WithLabelValues(src.project).Inc()
+				if src.project != "" {
+					err = fmt.Errorf("project %s: %w", src.project, err)
+				}
+				errsMu.Lock()
+				errs = append(errs, err)
+				errsMu.Unlock()
+			}
+		}(src)
+	}
+	wg.Wait()
+
+	// Файл для textfile collector обновляется после каждого цикла
+	if cfg.output != "" {
+		if err := writeMetricsFile(cfg.output); err != nil {
+			errs = append(errs, fmt.Errorf("write output: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Разбирает источник, ожидая не дольше -source-timeout. Разбор по файловой системе
+// нельзя прервать, поэтому зависший разбор продолжается в фоне и опубликует
+// снимок, если все же завершится; следующий цикл этот источник пропустит
+func parseSource(src *reportSource) error {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		err := parseAllureReports(src)
+		exporterMetrics.sourceDuration.WithLabelValues(src.project).Set(time.Since(start).Seconds())
+		done <- err
+	}()
+
+	if cfg.sourceTimeout <= 0 {
+		return <-done
+	}
+	timer := time.NewTimer(cfg.sourceTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		logger.Warn("Report source parse timed out",
+			zap.String("project", src.project),
+			zap.String("location", src.location),
+			zap.Duration("timeout", cfg.sourceTimeout))
+		return fmt.Errorf("parse timed out after %s", cfg.sourceTimeout)
+	}
+}
+
+// Пишет метрики реестра в файл в текстовом формате Prometheus. Файл подменяется
+// переименованием, чтобы читатель не увидел его недописанным
+func writeMetricsFile(name string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writeMetrics(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Текущее состояние реестра в текстовом формате Prometheus
+func writeMetrics(w io.Writer) error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gather: %w", err)
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return fmt.Errorf("encode %s: %w", mf.GetName(), err)
+		}
+	}
+	return nil
+}
+
+func runParser(source *reportSource) {
+	// Число неудачных циклов подряд: в отличие от накопительных счетчиков
+	// показывает, сломан ли экспортер прямо сейчас
+	failures := 0
+	trackResult := func(err error) {
+		if err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+		exporterMetrics.consecutiveFailures.Set(float64(failures))
+	}
+
+	// Первоначальный парсинг
+	err := parseSources(source)
+	if err != nil {
+		logger.Error("Initial parse failed", zap.Error(err))
+	}
+	trackResult(err)
+
+	// Однократный парсинг
+	if cfg.interval == 0 {
+		return
+	}
+
+	// Периодическое обновление
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	go func() {
+		for range ticker.C {
+			requestParse()
+		}
+	}()
+
+	for range parseTrigger {
+		if coalesced := atomic.SwapInt64(&pendingParses, 0); coalesced > 1 {
+			logger.Info("Coalesced parse requests", zap.Int64("count", coalesced))
+		}
+		exporterMetrics.parseQueueDepth.Set(0)
+
+		err := parseSources(source)
+		if err != nil {
+			logger.Error("Periodic parse failed", zap.Error(err))
+		}
+		trackResult(err)
+	}
+}
+
+// Ставит парсинг в очередь; запросы, пришедшие до его начала, схлопываются в один
+func requestParse() {
+	exporterMetrics.parseQueueDepth.Set(float64(atomic.AddInt64(&pendingParses, 1)))
+	select {
+	case parseTrigger <- struct{}{}:
+	default:
+	}
+}
+
+func parseAllureReports(src *reportSource) error {
+	if !src.mu.TryLock() {
+		return fmt.Errorf("previous parse of %s is still running", src.location)
+	}
+	defer src.mu.Unlock()
+
+	// Отчет не менялся с прошлого успешного цикла — обновляем только время парсинга.
+	// С -since окно сдвигается каждый цикл, и тот же отчет дает другой набор тестов,
+	// поэтому пропуск отключен
+	var fingerprint string
+	if cfg.skipUnchanged && cfg.since == 0 {
+		fingerprint = reportFingerprint(src.fsys)
+		if published := reportCollector.snapshot(src.project); fingerprint != "" && fingerprint == src.fingerprint && published != nil {
+			// Тот же снимок с новым временем парсинга; смена окружения уже показана прошлым циклом
+			unchanged := *published
+			unchanged.EnvChanged = false
+			unchanged.StatusChanges = 0
+			unchanged.ParsedAt = time.Now()
+			reportCollector.publish(src.project, &unchanged)
+			atomic.StoreInt64(&lastParseTime, unchanged.ParsedAt.UnixNano())
+			logger.Info("Report unchanged, parsing skipped")
+			return nil
+		}
+	}
+	// Отпечаток запоминается только успешным циклом: после сбоя опубликован
+	// неполный снимок, и тот же отчет нужно разобрать заново
+	src.fingerprint = ""
+
+	startTime := time.Now()
+	snap := &ReportSnapshot{}
+	defer func() {
+		// Недописанный отчет не публикуется, снаружи остаются метрики прошлого цикла
+		if snap != nil {
+			if snap.Summary != nil {
+				snap.StatusChanges = trackStatuses(src, snap.testStatuses)
+			}
+			if snap.EnvHash != "" {
+				snap.EnvChanged = trackEnvironment(src, snap.EnvHash)
+			}
+			snap.ParsedAt = time.Now()
+			snap.ParseDuration = snap.ParsedAt.Sub(startTime)
+			reportCollector.publish(src.project, snap)
+			atomic.StoreInt64(&lastParseTime, snap.ParsedAt.UnixNano())
+			countProcessed(snap.Summary)
+		}
+
+		// Память после цикла помогает подобрать лимиты контейнера под размер отчета
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		exporterMetrics.parseAllocBytes.Set(float64(mem.HeapAlloc))
+
+		logger.Info("Parsing completed",
+			zap.String("project", src.project),
+			zap.Duration("duration", time.Since(startTime)))
+	}()
+
+	// Результаты Allure 1 разбираются из XML в тот же снимок
+	if cfg.format == "allure1" {
+		return parseAllure1Report(src, snap)
+	}
+
+	source := src.fsys
+
+	// 1. Парсинг environment
+	if env, err := parseEnvironment(source, "environment.json"); err == nil {
+		snap.Environment = env
+		snap.EnvHash = hashEnvironment(env)
+		snap.stage("environment", nil)
+	} else {
+		logger.Warn("Environment parse failed", zap.Error(err))
+		snap.stage("environment", err)
+	}
+
+	// 2. Парсинг executor
+	if executor, err := parseExecutor(source, "executor.json"); err == nil {
+		snap.Executor = executor
+		snap.stage("executor", nil)
+	} else {
+		logger.Warn("Executor parse failed", zap.Error(err))
+		snap.stage("executor", err)
+	}
+
+	// 3. Сырые allure-results (до allure generate) не содержат summary: из них
+	// считаются только контейнеры со ссылками на отсутствующие результаты,
+	// которые говорят о неполной выгрузке
+	if isRawResults(source) {
+		orphaned, err := orphanedContainers(source)
+		snap.OrphanedFiles = orphaned
+		snap.stage("containers", err)
+		if err != nil {
+			return fmt.Errorf("containers parse failed: %w", err)
+		}
+		snap.Raw = true
+		logger.Info("Raw allure-results found, only orphaned containers are counted",
+			zap.Int("orphaned", orphaned))
+		return nil
+	}
+
+	// 4. Парсинг summary
+	summary, err := parseSummaries(source)
+	snap.stage("summary", err)
+	if err != nil {
+		return fmt.Errorf("summary parse failed: %w", err)
+	}
+	snap.Summary = summary
+
+	snap.FormatVersion = detectFormatVersion(source)
+
+	// 5. Парсинг history trend; история может храниться отдельно от отчета
+	historySource, historyName := source, path.Join("widgets", "history-trend.json")
+	if historyFS != nil {
+		historySource, historyName = historyFS, historyFile
+	}
+	if history, err := parseHistoryTrend(historySource, historyName); err == nil {
+		snap.History = history
+		snap.stage("history", nil)
+	} else {
+		logger.Warn("History trend parse failed", zap.Error(err))
+		snap.stage("history", err)
+	}
+
+	// 6. Парсинг packages; виджет есть не во всех отчетах, поэтому его отсутствие не ошибка
+	if packages, err := parsePackages(source, path.Join("widgets", "packages.json")); err == nil {
+		snap.Packages = packages
+		snap.stage("packages", nil)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		logger.Warn("Packages parse failed", zap.Error(err))
+		snap.stage("packages", err)
+	}
+
+	// 7. Парсинг тест-кейсов
+	testFiles, err := testCaseFiles(source)
+	snap.stage("test_cases", err)
+	if err != nil {
+		return fmt.Errorf("test cases glob failed: %w", err)
+	}
+
+	snap.TestCaseFiles = len(testFiles)
+
+	// Файлы читаются в -parse-workers потоков, и каждый тест-кейс сразу учитывается
+	// в метриках снимка и отбрасывается. Учет идет в порядке файлов, чтобы поиск
+	// дубликатов и лимит значений меток не зависели от порядка завершения воркеров;
+	// прочитанных, но еще не учтенных тест-кейсов не больше -parse-workers
+	type parsedFile struct {
+		tc      *AllureTestCase
+		modTime time.Time
+	}
+	sem := make(chan struct{}, cfg.parseWorkers)
+	pending := make(chan chan parsedFile, cfg.parseWorkers)
+	go func() {
+		defer close(pending)
+		for _, testFile := range testFiles {
+			sem <- struct{}{}
+			result := make(chan parsedFile, 1)
+			pending <- result
+			go func(testFile string) {
+				var parsed parsedFile
+				defer func() { result <- parsed }()
+
+				if info, err := fs.Stat(source, testFile); err == nil {
+					parsed.modTime = info.ModTime()
+				}
+
+				fileStart := time.Now()
+				tc, err := parseTestCase(source, testFile)
+				if cfg.profileParse {
+					exporterMetrics.testcaseParse.Observe(time.Since(fileStart).Seconds())
+				}
+				if err != nil {
+					logger.Warn("Test case parse failed",
+						zap.String("file", testFile),
+						zap.Error(err))
+					return
+				}
+				parsed.tc = tc
+			}(testFile)
+		}
+	}()
+
+	i := 0
+	for result := range pending {
+		parsed := <-result
+		<-sem
+		if parsed.modTime.After(snap.NewestModTime) {
+			snap.NewestModTime = parsed.modTime
+		}
+		if parsed.tc == nil {
+			snap.ParseErrors++
+		} else {
+			snap.addTestCase(parsed.tc, testFiles[i])
+		}
+		i++
+	}
+
+	// Поток тест-кейсов в формате JSON Lines
+	if err := parseTestCaseStream(source, path.Join("data", "test-cases.jsonl"), snap); err == nil {
+		snap.stage("test_case_stream", nil)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		logger.Warn("Test case stream parse failed", zap.Error(err))
+		snap.stage("test_case_stream", err)
+	}
+
+	// summary.json пишется раньше, чем генератор заканчивает data/test-cases
+	if cfg.requireComplete && !snap.complete(cfg.completeTolerance) {
+		logger.Warn("Report looks incomplete, keeping previous metrics",
+			zap.String("project", src.project),
+			zap.Int("summary_total", snap.Summary.total()),
+			zap.Int("test_cases", snap.TestCasesFound))
+		snap = nil
+		return nil
+	}
+
+	src.fingerprint = fingerprint
+	return nil
+}
+
+// Добавляет summary разобранного отчета к накопительному счетчику -emit-counters;
+// пропущенный неизменный отчет не учитывается повторно
+func countProcessed(summary *AllureSummary) {
+	if exporterMetrics.testsProcessed == nil || summary == nil {
+		return
+	}
+	exporterMetrics.testsProcessed.WithLabelValues("passed").Add(float64(summary.Statistic.Passed))
+	exporterMetrics.testsProcessed.WithLabelValues("failed").Add(float64(summary.Statistic.Failed))
+	exporterMetrics.testsProcessed.WithLabelValues("broken").Add(float64(summary.Statistic.Broken))
+	exporterMetrics.testsProcessed.WithLabelValues("skipped").Add(float64(summary.Statistic.Skipped))
+}
+
+// Список файлов тест-кейсов отчета
+func testCaseFiles(source fs.FS) ([]string, error) {
+	dir := path.Join("data", "test-cases")
+	if !cfg.recursive {
+		return fs.Glob(source, path.Join(dir, "*.json"))
+	}
+
+	// Некоторые раскладки хранят тест-кейсы во вложенных директориях по сьютам
+	var files []string
+	err := fs.WalkDir(source, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && path.Ext(name) == ".json" {
+			files = append(files, name)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		// Как и Glob, отсутствующая директория означает пустой список
+		return nil, nil
+	}
+	return files, err
+}
+
+// Контейнер сырых результатов: children — uuid результатов (<uuid>-result.json)
+type allureContainer struct {
+	Children []string `json:"children"`
+}
+
+// Сырые результаты: в корне лежат *-result.json или *-container.json, а summary
+// сгенерированного отчета нет
+func isRawResults(source fs.FS) bool {
+	if summaries, _ := fs.Glob(source, "widgets/summary*.json"); len(summaries) > 0 {
+		return false
+	}
+	for _, pattern := range []string{"*-result.json", "*-container.json"} {
+		if files, _ := fs.Glob(source, pattern); len(files) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Считает контейнеры, ссылающиеся на отсутствующие результаты.
+// Результаты без контейнера не считаются: адаптеры пишут контейнеры только для фикстур
+func orphanedContainers(source fs.FS) (orphaned int, err error) {
+	containers, err := fs.Glob(source, "*-container.json")
+	if err != nil || len(containers) == 0 {
+		return 0, err
+	}
+	results, err := fs.Glob(source, "*-result.json")
+	if err != nil {
+		return 0, err
+	}
+
+	uuids := make(map[string]bool, len(results))
+	for _, name := range results {
+		uuids[strings.TrimSuffix(name, "-result.json")] = true
+	}
+
+	for _, name := range containers {
+		data, err := readReportFile(source, name)
+		if err != nil {
+			return orphaned, readError(name, err)
+		}
+		var container allureContainer
+		if err := json.Unmarshal(data, &container); err != nil {
+			return orphaned, &ErrMalformedJSON{File: name, Err: err}
+		}
+		for _, child := range container.Children {
+			if !uuids[child] {
+				orphaned++
+				break
+			}
+		}
+	}
+	return orphaned, nil
+}
+
+// Считает отпечаток отчета: содержимое summary всех шардов плюс размер и время изменения
+// остальных файлов, чтобы появление и исчезновение файлов тоже меняло отпечаток
+func reportFingerprint(source fs.FS) string {
+	summaries, err := fs.Glob(source, path.Join("widgets", "summary*.json"))
+	if err != nil || len(summaries) == 0 {
+		return ""
+	}
+
+	h := sha256.New()
+	for _, name := range summaries {
+		summary, err := readReportFile(source, name)
+		if err != nil {
+			return ""
+		}
+		h.Write(summary)
+	}
+
+	files := []string{"environment.json", "executor.json", path.Join("widgets", "history-trend.json"), path.Join("data", "test-cases.jsonl")}
+	testFiles, err := testCaseFiles(source)
+	if err != nil {
+		return ""
+	}
+	files = append(files, testFiles...)
+
+	for _, name := range files {
+		info, err := fs.Stat(source, name)
+		if err != nil {
+			fmt.Fprintf(h, "%s missing\n", name)
+			continue
+		}
+		fmt.Fprintf(h, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+	}
+	if historyFS != nil {
+		if info, err := fs.Stat(historyFS, historyFile); err == nil {
+			fmt.Fprintf(h, "history %d %d\n", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Парсинг отдельных файлов
+func parseEnvironment(source fs.FS, name string) (AllureEnvironment, error) {
+	data, err := readReportFile(source, name)
+	if err != nil {
+		return nil, readError(name, err)
+	}
+
+	var env AllureEnvironment
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, &ErrMalformedJSON{File: name, Err: err}
+	}
+
+	return env, nil
+}
+
+func parseExecutor(source fs.FS, name string) (*AllureExecutor, error) {
+	data, err := readReportFile(source, name)
+	if err != nil {
+		return nil, readError(name, err)
+	}
+
+	var executor AllureExecutor
+	if err := json.Unmarshal(data, &executor); err != nil {
+		return nil, &ErrMalformedJSON{File: name, Err: err}
+	}
+
+	return &executor, nil
+}
+
+func parseSummary(source fs.FS, name string) (*AllureSummary, error) {
+	data, err := readReportFile(source, name)
+	if err != nil {
+		return nil, readError(name, err)
+	}
+
+	var summary AllureSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, &ErrMalformedJSON{File: name, Err: err}
+	}
+
+	// Без statistic summary разобрался бы в нули, неотличимые от пустого прогона
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, &ErrMalformedJSON{File: name, Err: err}
+	}
+	if _, ok := fields["statistic"]; !ok {
+		return nil, &ErrMissingField{File: name, Field: "statistic"}
+	}
+
+	return &summary, nil
+}
+
+// Шардированный прогон дает по summary на шард (widgets/summary*.json):
+// их статистика и длительности складываются. Единственный файл разбирается как есть
+func parseSummaries(source fs.FS) (*AllureSummary, error) {
+	names, err := fs.Glob(source, path.Join("widgets", "summary*.json"))
+	if err != nil {
+		return nil, err
+	}
+	switch len(names) {
+	case 0:
+		return parseSummary(source, path.Join("widgets", "summary.json"))
+	case 1:
+		return parseSummary(source, names[0])
+	}
+
+	combined := &AllureSummary{}
+	for _, name := range names {
+		summary, err := parseSummary(source, name)
+		if err != nil {
+			return nil, err
+		}
+		combined.add(summary)
+	}
+	logger.Debug("Combined sharded summaries", zap.Int("files", len(names)))
+	return combined, nil
+}
+
+var (
+	// <meta name="generator" content="..."> в index.html отчета
+	generatorMeta = regexp.MustCompile(`(?i)<meta\s+name="generator"\s+content="([^"]*)"`)
+	// Версия генератора: "Allure Report 2.29.0", "allure-report 3.0.0" и т.п.
+	generatorVersion = regexp.MustCompile(`(?i)allure[ -]?(?:report|framework)?\s*v?(\d+(?:\.\d+)*)`)
+)
+
+// Версия Allure, сгенерировавшего отчет: из meta generator в index.html или из
+// полей generator/version в widgets/summary.json. Саму версию формат Allure 2
+// не хранит, поэтому без этих полей версия неизвестна
+func detectFormatVersion(source fs.FS) string {
+	if data, err := readReportFile(source, "index.html"); err == nil {
+		if m := generatorMeta.FindSubmatch(data); m != nil {
+			if version := generatorVersion.FindStringSubmatch(string(m[1])); version != nil {
+				return version[1]
+			}
+		}
+	}
+
+	if data, err := readReportFile(source, path.Join("widgets", "summary.json")); err == nil {
+		var fields struct {
+			Generator string `json:"generator"`
+			Version   string `json:"version"`
+		}
+		if json.Unmarshal(data, &fields) == nil {
+			if version := generatorVersion.FindStringSubmatch(fields.Generator); version != nil {
+				return version[1]
+			}
+			if fields.Version != "" {
+				return fields.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+func parseHistoryTrend(source fs.FS, name string) (*AllureHistoryTrend, error) {
+	data, err := readReportFile(source, name)
+	if err != nil {
+		return nil, readError(name, err)
+	}
+
+	var history AllureHistoryTrend
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, &ErrMalformedJSON{File: name, Err: err}
+	}
+
+	return &history, nil
+}
+
+func parsePackages(source fs.FS, name string) (*AllurePackages, error) {
+	data, err := readReportFile(source, name)
+	if err != nil {
+		return nil, readError(name, err)
+	}
+
+	var packages AllurePackages
+	if err := json.Unmarshal(data, &packages); err != nil {
+		return nil, &ErrMalformedJSON{File: name, Err: err}
+	}
+
+	return &packages, nil
+}
+
+// Длина строки потока при -max-file-size 0
+const maxStreamLine = 64 << 20
+
+// Читает поток тест-кейсов построчно, не загружая файл целиком.
+// Строка ограничена -max-file-size, как и отдельный файл тест-кейса
+func parseTestCaseStream(source fs.FS, name string, snap *ReportSnapshot) error {
+	f, err := source.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	maxLine := maxStreamLine
+	if cfg.maxFileSize > 0 && cfg.maxFileSize < maxStreamLine {
+		maxLine = int(cfg.maxFileSize)
+	}
+
+	reader := bufio.NewReaderSize(f, 64*1024)
+	for line := 1; ; line++ {
+		raw, tooLong, err := readStreamLine(reader, maxLine)
+		if tooLong {
+			logger.Warn("Test case line too long, skipped",
+				zap.String("file", name),
+				zap.Int("line", line),
+				zap.Int("max_bytes", maxLine))
+			snap.ParseErrors++
+		} else if data := bytes.TrimSpace(raw); len(data) > 0 {
+			parseStreamTestCase(data, name, line, snap)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+	}
+}
+
+// Читает строку потока без перевода строки. Строка длиннее maxLine не
+// накапливается в памяти, а дочитывается до конца и пропускается
+func readStreamLine(r *bufio.Reader, maxLine int) (line []byte, tooLong bool, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		chunk = bytes.TrimSuffix(chunk, []byte("\n"))
+		if !tooLong && len(line)+len(chunk) > maxLine {
+			line, tooLong = nil, true
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		if err != bufio.ErrBufferFull {
+			return line, tooLong, err
+		}
+	}
+}
+
+func parseStreamTestCase(data []byte, name string, line int, snap *ReportSnapshot) {
+	var tc AllureTestCase
+	if err := json.Unmarshal(data, &tc); err != nil {
+		logger.Warn("Test case parse failed",
+			zap.String("file", name),
+			zap.Int("line", line),
+			zap.Error(err))
+		snap.ParseErrors++
+		return
+	}
+	tc.normalizeStatuses()
+	snap.addTestCase(&tc, fmt.Sprintf("%s:%d", name, line))
+}
+
+func parseTestCase(source fs.FS, name string) (*AllureTestCase, error) {
+	data, err := readReportFile(source, name)
+	if err != nil {
+		return nil, readError(name, err)
+	}
+
+	var tc AllureTestCase
+	if err := json.Unmarshal(data, &tc); err != nil {
+		return nil, &ErrMalformedJSON{File: name, Err: err}
+	}
+	tc.normalizeStatuses()
+
+	return &tc, nil
+}
+
+// Читает файл отчета, повторяя чтение при временных ошибках хранилища
+func readReportFile(source fs.FS, name string) ([]byte, error) {
+	data, err := readReportFileOnce(source, name)
+	for attempt := 1; attempt <= cfg.readRetries && isTransientReadError(err); attempt++ {
+		exporterMetrics.readRetries.WithLabelValues(readStage(name)).Inc()
+		logger.Debug("Retrying report file read",
+			zap.String("file", name),
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		data, err = readReportFileOnce(source, name)
+	}
+	return data, err
+}
+
+// Отсутствующий или слишком большой файл при повторе не изменится
+func isTransientReadError(err error) bool {
+	return err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrInvalid) && !errors.Is(err, errFileTooLarge)
+}
+
+// Этап парсинга по имени файла, чтобы не выводить имена тест-кейсов в метки
+func readStage(name string) string {
+	switch path.Base(name) {
+	case "environment.json", "environment.xml":
+		return "environment"
+	case "executor.json":
+		return "executor"
+	case "history-trend.json":
+		return "history"
+	case "packages.json":
+		return "packages"
+	case "index.html":
+		return "format"
+	}
+	base := path.Base(name)
+	switch {
+	case strings.HasSuffix(base, "-container.json"):
+		return "container"
+	case strings.HasSuffix(base, "-testsuite.xml"):
+		return "allure1_xml"
+	}
+	if shard, _ := path.Match("summary*.json", base); shard {
+		return "summary"
+	}
+	return "test_case"
+}
+
+// Читает файл отчета, не загружая в память больше -max-file-size байт
+func readReportFileOnce(source fs.FS, name string) ([]byte, error) {
+	if cfg.maxFileSize <= 0 {
+		return fs.ReadFile(source, name)
+	}
+
+	f, err := source.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Размер из Stat позволяет отбросить файл, не читая его
+	if info, err := f.Stat(); err == nil && info.Size() > cfg.maxFileSize {
+		exporterMetrics.filesTooLarge.Inc()
+		return nil, fmt.Errorf("%w: %d > %d bytes", errFileTooLarge, info.Size(), cfg.maxFileSize)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(f, cfg.maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > cfg.maxFileSize {
+		exporterMetrics.filesTooLarge.Inc()
+		return nil, fmt.Errorf("%w: more than %d bytes", errFileTooLarge, cfg.maxFileSize)
+	}
+	return data, nil
+}
+
+// Сравнивает окружение с прошлым опубликованным снимком источника; вызывается
+// только при публикации, чтобы отброшенный -require-complete отчет не сдвигал
+// хэш, с которым сравнивается следующий цикл
+func trackEnvironment(src *reportSource, hash string) bool {
+	changed := src.envHash != "" && src.envHash != hash
+	if changed {
+		logger.Info("Environment changed",
+			zap.String("project", src.project),
+			zap.String("previous", src.envHash),
+			zap.String("current", hash))
+	}
+	src.envHash = hash
+	return changed
+}
+
+// Считает тесты, статус которых изменился с прошлого цикла; новые и
+// пропавшие тесты изменениями не считаются, из повторов имени берется последний.
+// statuses — статусы тестов текущего цикла по имени
+func trackStatuses(src *reportSource, statuses map[string]string) int {
+	changes := 0
+	for name, status := range statuses {
+		if previous, ok := src.testStatuses[name]; ok && previous != status {
+			changes++
+		}
+	}
+	src.testStatuses = statuses
+	return changes
+}
+
+// Обновление метрик
+func updateEnvironmentMetrics(m *reportMetrics, snap *ReportSnapshot) {
+	for k, v := range snap.Environment {
+		m.environmentInfo.WithLabelValues(k, v).Set(1)
+	}
+	m.environmentKeys.Set(float64(len(snap.Environment)))
+
+	m.envHashInfo.WithLabelValues(snap.EnvHash).Set(1)
+	if snap.EnvChanged {
+		m.envChanged.Set(1)
+	}
+}
+
+// Ключи environment, под которыми CI обычно записывает ревизию и ветку
+var (
+	commitKeys = []string{"commit", "git_commit", "commit_sha", "git_sha", "revision"}
+	branchKeys = []string{"branch", "git_branch", "branch_name"}
+)
+
+// Ревизия под тестом для привязки регрессий к коммиту; без обоих ключей серия не выводится
+func updateRunInfoMetrics(m *reportMetrics, env AllureEnvironment) {
+	commit, branch := lookupEnvironment(env, commitKeys), lookupEnvironment(env, branchKeys)
+	if commit == "" && branch == "" {
+		return
+	}
+	m.runInfo.WithLabelValues(commit, branch).Set(1)
+}
+
+// Первое непустое значение среди ключей без учета регистра
+func lookupEnvironment(env AllureEnvironment, keys []string) string {
+	for _, key := range keys {
+		for k, v := range env {
+			if strings.EqualFold(k, key) && v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+func updateExecutorMetrics(m *reportMetrics, executor *AllureExecutor) {
+	m.executorInfo.WithLabelValues(
+		executor.Name,
+		executor.BuildName,
+		executor.BuildURL,
+		executor.Type,
+	).Set(1)
+}
+
+func updateSummaryMetrics(m *reportMetrics, summary *AllureSummary) {
+	m.testsTotal.WithLabelValues("passed").Set(float64(summary.Statistic.Passed))
+	m.testsTotal.WithLabelValues("failed").Set(float64(summary.Statistic.Failed))
+	m.testsTotal.WithLabelValues("broken").Set(float64(summary.Statistic.Broken))
+	m.testsTotal.WithLabelValues("skipped").Set(float64(summary.Statistic.Skipped))
+	m.suiteDuration.Set(float64(summary.Time.Duration) / 1000)
+	m.summaryTotal.Set(float64(summary.total()))
+
+	// Много broken на один failed указывает на нестабильное окружение, а не на дефекты;
+	// без failed отношение не определено и остается нулевым
+	if failed := summary.Statistic.Failed; failed > 0 {
+		m.brokenToFailed.Set(float64(summary.Statistic.Broken) / float64(failed))
+	}
+
+	// Итоговый красный/зеленый статус по порогу падений
+	failures := float64(summary.Statistic.Failed + summary.Statistic.Broken)
+	limit := cfg.failureThresholdValue
+	if cfg.failureThresholdPercent {
+		limit = float64(summary.total()) * cfg.failureThresholdValue / 100
+	}
+	healthy := 0.0
+	if failures <= limit {
+		healthy = 1.0
+	}
+	m.suiteHealthy.Set(healthy)
+}
+
+func updateHistoryMetrics(m *reportMetrics, history *AllureHistoryTrend) {
+	// Без истории flaky ratio остается нулевым в свежем наборе, а не устаревшим
+	if len(history.Items) == 0 {
+		return
+	}
+	m.historyAvailable.Set(1)
+
+	for i, item := range history.Items {
+		build := fmt.Sprintf("build_%d", i)
+		m.historyTrend.WithLabelValues(build).Set(float64(item.Data.Failed))
+
+		// Старые отчеты хранят в истории не все поля; total тогда считается по статусам
+		data := item.Data
+		total := data.Total
+		if total == 0 {
+			total = data.Passed + data.Failed + data.Broken + data.Skipped + data.Unknown
+		}
+		m.historyTests.WithLabelValues(build, "passed").Set(float64(data.Passed))
+		m.historyTests.WithLabelValues(build, "failed").Set(float64(data.Failed))
+		m.historyTests.WithLabelValues(build, "broken").Set(float64(data.Broken))
+		m.historyTests.WithLabelValues(build, "skipped").Set(float64(data.Skipped))
+		m.historyTests.WithLabelValues(build, "total").Set(float64(total))
+	}
+
+	m.flakyRatio.Set(flakyRatio(history))
+}
+
+// Доля сборок истории с падениями; для пустой истории не вызывается
+func flakyRatio(history *AllureHistoryTrend) float64 {
+	failedCount := 0
+	for _, item := range history.Items {
+		if item.Data.Failed > 0 {
+			failedCount++
+		}
+	}
+	return float64(failedCount) / float64(len(history.Items))
+}
+
+// Сравнение текущих падений со средним по последним сборкам из истории
+func updateBaselineMetrics(m *reportMetrics, summary *AllureSummary, history *AllureHistoryTrend) {
+	if len(history.Items) == 0 {
+		return
+	}
+
+	// Allure кладет самые свежие сборки в начало списка
+	recent := history.Items
+	if len(recent) > cfg.baselineBuilds {
+		recent = recent[:cfg.baselineBuilds]
+	}
+
+	total := 0
+	for _, item := range recent {
+		total += item.Data.Failed
+	}
+	baseline := float64(total) / float64(len(recent))
+	m.failuresBaseline.Set(float64(summary.Statistic.Failed) - baseline)
+}
+
+// Учитывает тест-кейс в метриках; после finish набор не меняется
+func (m *testCaseMetrics) add(tc *AllureTestCase) {
+	updateTestCaseMetrics(m, tc)
+
+	m.tests++
+	if len(tc.Steps) == 0 {
+		m.withoutSteps++
+	}
+	if hasAttachments(tc.Attachments, tc.Steps) {
+		m.withAttachments++
+	}
+	if tc.Status == "failed" || tc.Status == "broken" {
+		m.failed++
+		m.failedSteps += countSteps(tc.Steps)
+	}
+
+	// Здоровье сьюта от 0 до 100. Вклад теста — вес его статуса (-weight, неуказанные
+	// статусы весят 0), умноженный на ранг severity + 1, чтобы trivial не обнулялся.
+	// finish переводит сумму вкладов в шкалу между худшим исходом (все тесты
+	// с минимальным весом) и лучшим (все с максимальным)
+	minWeight, maxWeight := weightBounds()
+	multiplier := float64(severityRank(getLabelValue(tc.Labels, "severity")) + 1)
+	m.healthSum += cfg.weights[strings.ToLower(tc.Status)] * multiplier
+	m.healthWorst += minWeight * multiplier
+	m.healthBest += maxWeight * multiplier
+
+	// Доля прошедших по фичам; пропущенные и неизвестные статусы не учитываются
+	if tc.Status == "passed" || tc.Status == "failed" || tc.Status == "broken" {
+		for _, label := range tc.Labels {
+			if normalizeLabelName(label.Name) != "feature" {
+				continue
+			}
+			feature := boundLabelValue(&m.labels, "feature", label.Value)
+			m.featureCounted[feature]++
+			if tc.Status == "passed" {
+				m.featurePassed[feature]++
+			}
+		}
+	}
+
+	// Число различных тегов не зависит от отбора меток и лимитов
+	for _, label := range tc.Labels {
+		if normalizeLabelName(label.Name) != "tag" {
+			continue
+		}
+		if tag := strings.TrimSpace(label.Value); tag != "" {
+			m.tags[tag] = true
+		}
+	}
+}
+
+// Переносит промежуточные итоги в метрики по всем тестам и освобождает их
+func (m *testCaseMetrics) finish() *testCaseMetrics {
+	m.finishOnce.Do(func() {
+		m.testsNoSteps.Set(float64(m.withoutSteps))
+		if m.tests > 0 {
+			m.attachedRatio.Set(float64(m.withAttachments) / float64(m.tests))
+			m.healthScore.WithLabelValues().Set(100 * (m.healthSum - m.healthWorst) / (m.healthBest - m.healthWorst))
+			// Доля тестов с каждым типом метки, включая типы, которых нет ни у одного теста
+			for labelType := range usefulLabels {
+				m.labelCoverage.WithLabelValues(labelType).Set(float64(m.testsWithLabel[labelType]) / float64(m.tests))
+			}
+		}
+		if m.failed > 0 {
+			m.failedAvgSteps.Set(float64(m.failedSteps) / float64(m.failed))
+		}
+		for feature, count := range m.featureCounted {
+			m.featurePassRatio.WithLabelValues(feature).Set(float64(m.featurePassed[feature]) / float64(count))
+		}
+		m.distinctTags.Set(float64(len(m.tags)))
+		m.featurePassed, m.featureCounted, m.tags = nil, nil, nil
+	})
+	return m
+}
+
+func updateTestCaseMetrics(m *testCaseMetrics, tc *AllureTestCase) {
+	// Посерийные метрики теста только для разрешенных статусов
+	if emitPerTestSeries(tc) {
+		updatePerTestMetrics(m, tc)
+	}
+
+	// Длинные имена обычно содержат параметры и грозят ростом числа серий
+	m.nameLength.Observe(float64(utf8.RuneCountInString(tc.Name)))
+
+	// Много ретраев у немногих тестов и по одному у многих — разные виды нестабильности
+	m.retryCount.Observe(float64(tc.RetriesCount))
+
+	// Распределение длительностей по всем тестам
+	duration := time.Duration(tc.Stop-tc.Start) * time.Millisecond
+	m.durationHist.Observe(duration.Seconds())
+	m.durationByStatus.WithLabelValues(tc.Status).Add(duration.Seconds())
+
+	// Превышение SLA по длительности для severity теста
+	severity := strings.ToLower(getLabelValue(tc.Labels, "severity"))
+	if limit, ok := cfg.sla[severity]; ok && duration > limit {
+		m.overSLA.WithLabelValues(severity).Inc()
+	}
+
+	// Один отчет может покрывать несколько окружений, например staging и prod
+	m.testsByEnv.WithLabelValues(getLabelValue(tc.Labels, cfg.envLabel), tc.Status).Inc()
+
+	// Здоровье по слоям пирамиды тестов
+	m.testsByLayer.WithLabelValues(getLabelValue(tc.Labels, "layer"), tc.Status).Inc()
+
+	// Сводная таблица без имени теста в метках
+	m.testMatrix.WithLabelValues(getLabelValue(tc.Labels, "suite"), tc.Status, severity).Inc()
+
+	// Поломки по таймауту отделяются от дефектов самого теста
+	if isTimedOut(tc) {
+		m.timedOut.Inc()
+	}
+
+	// Противоречие статуса теста и его шагов указывает на ошибку в обвязке тестов
+	if stepStatusMismatch(tc) {
+		m.stepMismatch.Inc()
+	}
+
+	// Глубина падений отличает сломанную подготовку от упавших проверок
+	countFailedSteps(m, tc.Steps, 1)
+
+	// Упавший UI-тест без скриншота означает, что хук снятия скриншота не сработал
+	if (tc.Status == "failed" || tc.Status == "broken") && !hasScreenshot(tc) {
+		m.noScreenshot.Inc()
+	}
+
+	// Статусы, которые не учитываются в summary
+	if !isKnownStatus(tc.Status) {
+		status := tc.Status
+		if status == "" {
+			status = "unknown"
+		}
+		m.unknownStatus.WithLabelValues(status).Inc()
+	}
+
+	// Группировка по тегам; с -all-labels без отбора, но с теми же лимитами кардинальности
+	labelTypes := make(map[string]bool)
+	for _, label := range tc.Labels {
+		if cfg.allLabels || isUsefulLabel(label.Name) {
+			// Severity и " severity " — одна серия, как и при отборе полезных меток
+			labelType := normalizeLabelName(label.Name)
+			value := boundLabelValue(&m.labels, labelType, label.Value)
+			m.testsByLabel.WithLabelValues(labelType, value).Inc()
+			labelTypes[labelType] = true
+		}
+	}
+	for labelType := range labelTypes {
+		m.testsWithLabel[labelType]++
+	}
+
+	// Из повторной метки getLabelValue возьмет только первое значение
+	labelCounts := make(map[string]int)
+	for _, label := range tc.Labels {
+		if name := normalizeLabelName(label.Name); isSingleValueLabel(name) {
+			labelCounts[name]++
+		}
+	}
+	for name, count := range labelCounts {
+		if count > 1 {
+			m.duplicateLabels.WithLabelValues(name).Inc()
+		}
+	}
+
+	// Распределение по часу старта; start хранится в миллисекундах epoch
+	if tc.Start > 0 {
+		hour := time.UnixMilli(tc.Start).UTC().Hour()
+		m.testsByHour.WithLabelValues(strconv.Itoa(hour)).Inc()
+	}
+}
+
+// Версия формата отчета помогает связать аномалии парсинга с обновлением Allure
+func updateFormatMetrics(m *reportMetrics, version string) {
+	if version == "" {
+		m.formatVersion.WithLabelValues("unknown").Set(0)
+		return
+	}
+
+	major, _, _ := strings.Cut(version, ".")
+	value, err := strconv.Atoi(major)
+	if err != nil {
+		value = 0
+	}
+	m.formatVersion.WithLabelValues(version).Set(float64(value))
+}
+
+// Средняя длительность по сьютам: сьюты сильно различаются по размеру,
+// поэтому общее среднее мало что говорит
+func updateSuiteMetrics(m *reportMetrics, suites map[string]*SuiteCounts) {
+	for name, suite := range suites {
+		if suite.Total == 0 {
+			continue
+		}
+		m.suiteAvgDuration.WithLabelValues(name).Set(suite.DurationSeconds / float64(suite.Total))
+	}
+}
+
+// Тесты по пакетам: имя пакета собирается из узлов дерева над тестом через точку
+func updatePackageMetrics(m *reportMetrics, packages *AllurePackages) {
+	var walk func(nodes []PackageNode, pkg string)
+	walk = func(nodes []PackageNode, pkg string) {
+		for _, node := range nodes {
+			if len(node.Children) == 0 && node.Status != "" {
+				value := boundLabelValue(&m.packageLabels, "package", pkg)
+				m.packageTests.WithLabelValues(value, normalizeStatus(node.Status)).Inc()
+				continue
+			}
+
+			name := node.Name
+			if pkg != "" {
+				name = pkg + "." + node.Name
+			}
+			walk(node.Children, name)
+		}
+	}
+	walk(packages.Children, "")
+}
+
+// Метрики с именем теста в метках — основной источник кардинальности
+func updatePerTestMetrics(m *testCaseMetrics, tc *AllureTestCase) {
+	name := normalizeTestName(tc.Name)
+	if name != tc.Name {
+		m.testNameInfo.WithLabelValues(name, tc.Name).Set(1)
+	}
+
+	// Длительность теста
+	duration := float64(tc.Stop-tc.Start) / 1000
+	env := getLabelValue(tc.Labels, cfg.envLabel)
+	m.testDuration.WithLabelValues(name, getLabelValue(tc.Labels, "suite"), env).Set(duration)
+
+	// Статус теста
+	m.testStatus.WithLabelValues(
+		name,
+		tc.Status,
+		getLabelValue(tc.Labels, "severity"),
+		env,
+	).Set(cfg.statusValues[strings.ToLower(tc.Status)])
+
+	// Шаги теста
+	stepsByStatus := make(map[string]int)
+	var slowest *Step
+	for i, step := range tc.Steps {
+		stepsByStatus[step.Status]++
+		if step.Stop-step.Start > 0 && (slowest == nil || step.Stop-step.Start > slowest.Stop-slowest.Start) {
+			slowest = &tc.Steps[i]
+		}
+	}
+	for status, count := range stepsByStatus {
+		m.stepsTotal.WithLabelValues(name, status).Set(float64(count))
+	}
+
+	// Самый долгий шаг вместо серии на каждый шаг
+	if slowest != nil {
+		m.slowestStep.WithLabelValues(name, slowest.Name).Set(float64(slowest.Stop-slowest.Start) / 1000)
+	}
+
+	// Тяжелые вложения раздувают хранилище отчетов; без поля size серия не выводится
+	if size := attachmentsSize(tc.Attachments, tc.Steps); size > 0 {
+		m.attachmentBytes.WithLabelValues(name).Add(float64(size))
+	}
+
+	// Числовой ранг severity для запросов вида "severity >= critical"
+	m.severityRank.WithLabelValues(name).Set(float64(severityRank(getLabelValue(tc.Labels, "severity"))))
+}
+
+// Вспомогательные функции
+// Решает, выводить ли для теста посерийные метрики
+func emitPerTestSeries(tc *AllureTestCase) bool {
+	if cfg.perTestStatuses != nil && !cfg.perTestStatuses[strings.ToLower(tc.Status)] {
+		return false
+	}
+	if cfg.minPerTestSeverity != "" && severityRank(getLabelValue(tc.Labels, "severity")) < severityRank(cfg.minPerTestSeverity) {
+		return false
+	}
+	return true
+}
+
+// Убирает параметры из имени теста, чтобы параметризованные прогоны попадали в одну серию
+func normalizeTestName(name string) string {
+	if cfg.nameNormalizer == nil {
+		return name
+	}
+
+	normalized := strings.TrimSpace(cfg.nameNormalizer.ReplaceAllString(name, ""))
+	if normalized == "" {
+		return name
+	}
+	return normalized
+}
+
+// Извлекает значение конкретного тега (label) из списка меток тест-кейса
+func getLabelValue(labels []Label, name string) string {
+	name = normalizeLabelName(name)
+	for _, label := range labels {
+		if normalizeLabelName(label.Name) == name {
+			return label.Value
+		}
+	}
+	return cfg.unknownLabelValue
+}
+
+func hasLabel(labels []Label, name string) bool {
+	name = normalizeLabelName(name)
+	for _, label := range labels {
+		if normalizeLabelName(label.Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Считает стабильный хэш окружения независимо от порядка ключей
+func hashEnvironment(env AllureEnvironment) string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, env[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Переводит severity Allure в число; неизвестные значения считаются normal
+func severityRank(severity string) int {
+	switch strings.ToLower(severity) {
+	case "blocker":
+		return 4
+	case "critical":
+		return 3
+	case "minor":
+		return 1
+	case "trivial":
+		return 0
+	default:
+		return 2
+	}
+}
+
+// Наименьший и наибольший вес статуса из -weight; 0 в обе границы входит всегда
+func weightBounds() (minWeight, maxWeight float64) {
+	for _, weight := range cfg.weights {
+		minWeight, maxWeight = min(minWeight, weight), max(maxWeight, weight)
+	}
+	return minWeight, maxWeight
+}
+
+// Тест сломан по таймауту, если сообщение статуса содержит один из -timeout-patterns
+func isTimedOut(tc *AllureTestCase) bool {
+	if tc.Status != "broken" {
+		return false
+	}
+
+	message := strings.ToLower(tc.StatusDetails.Message)
+	for _, pattern := range cfg.timeoutPatterns {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Приводит статусы теста и шагов к нижнему регистру и словарю Allure по -status-alias
+func (tc *AllureTestCase) normalizeStatuses() {
+	tc.Status = normalizeStatus(tc.Status)
+	normalizeStepStatuses(tc.Steps)
+}
+
+func normalizeStepStatuses(steps []Step) {
+	for i := range steps {
+		steps[i].Status = normalizeStatus(steps[i].Status)
+		normalizeStepStatuses(steps[i].Steps)
+	}
+}
+
+func normalizeStatus(status string) string {
+	status = strings.ToLower(status)
+	if alias, ok := cfg.statusAliases[status]; ok {
+		return alias
+	}
+	return status
+}
+
+// Некоторые адаптеры не пишут start/stop теста, хотя время шагов есть.
+// Тогда время теста — от самого раннего старта до самого позднего окончания шагов
+func (tc *AllureTestCase) fillTimesFromSteps() {
+	if tc.Start > 0 && tc.Stop > 0 {
+		return
+	}
+	if start, stop := stepTimes(tc.Steps); start > 0 && stop > start {
+		tc.Start, tc.Stop = start, stop
+	}
+}
+
+// Самый ранний ненулевой start и самый поздний stop среди шагов со всеми вложенными
+func stepTimes(steps []Step) (start, stop int64) {
+	for _, step := range steps {
+		nestedStart, nestedStop := stepTimes(step.Steps)
+		for _, t := range []int64{step.Start, nestedStart} {
+			if t > 0 && (start == 0 || t < start) {
+				start = t
+			}
+		}
+		stop = max(stop, step.Stop, nestedStop)
+	}
+	return start, stop
+}
+
+// Число шагов со всеми вложенными
+func countSteps(steps []Step) int {
+	count := len(steps)
+	for _, step := range steps {
+		count += countSteps(step.Steps)
+	}
+	return count
+}
+
+// Суммарный размер вложений теста и всех его шагов
+func attachmentsSize(attachments []Attachment, steps []Step) int64 {
+	var size int64
+	for _, attachment := range attachments {
+		size += attachment.Size
+	}
+	for _, step := range steps {
+		size += attachmentsSize(step.Attachments, step.Steps)
+	}
+	return size
+}
+
+// Тест passed с упавшим шагом или упавший тест, у которого все шаги прошли
+func stepStatusMismatch(tc *AllureTestCase) bool {
+	statuses := make(map[string]int)
+	countStepStatuses(tc.Steps, statuses)
+	if len(statuses) == 0 {
+		return false
+	}
+
+	stepFailed := statuses["failed"]+statuses["broken"] > 0
+	switch tc.Status {
+	case "passed":
+		return stepFailed
+	case "failed", "broken":
+		return len(statuses) == 1 && statuses["passed"] > 0
+	}
+	return false
+}
+
+func countStepStatuses(steps []Step, statuses map[string]int) {
+	for _, step := range steps {
+		statuses[step.Status]++
+		countStepStatuses(step.Steps, statuses)
+	}
+}
+
+// Есть ли вложения у теста или у любого из его шагов
+func hasAttachments(attachments []Attachment, steps []Step) bool {
+	if len(attachments) > 0 {
+		return true
+	}
+	for _, step := range steps {
+		if hasAttachments(step.Attachments, step.Steps) {
+			return true
+		}
+	}
+	return false
+}
+
+// Считает упавшие шаги по уровням вложенности, обходя дерево шагов рекурсивно
+func countFailedSteps(m *testCaseMetrics, steps []Step, depth int) {
+	for _, step := range steps {
+		if step.Status == "failed" || step.Status == "broken" {
+			m.failedStepDepth.WithLabelValues(strconv.Itoa(depth)).Inc()
+		}
+		countFailedSteps(m, step.Steps, depth+1)
+	}
+}
+
+// Ищет вложение-скриншот у самого теста и у его шагов на любой глубине
+func hasScreenshot(tc *AllureTestCase) bool {
+	return hasScreenshotAttachment(tc.Attachments) || stepsHaveScreenshot(tc.Steps)
+}
+
+func stepsHaveScreenshot(steps []Step) bool {
+	for _, step := range steps {
+		if hasScreenshotAttachment(step.Attachments) || stepsHaveScreenshot(step.Steps) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasScreenshotAttachment(attachments []Attachment) bool {
+	for _, attachment := range attachments {
+		if cfg.screenshotTypes[strings.ToLower(attachment.Type)] {
+			return true
+		}
+	}
+	return false
+}
+
+// Проверяет, что статус входит в стандартный набор Allure
+func isKnownStatus(status string) bool {
+	switch status {
+	case "passed", "failed", "broken", "skipped":
+		return true
+	}
+	return false
+}
+
+// Ограничивает кардинальность allure_tests_by_label: лишние значения сводятся в "other"
+func boundLabelValue(limits *labelLimits, labelType, value string) string {
+	const overflow = "other"
+	key := normalizeLabelName(labelType)
+
+	if allowed, ok := cfg.labelAllow[key]; ok && !allowed[value] {
+		return overflow
+	}
+
+	if cfg.labelMaxValues > 0 {
+		seen := limits.valuesSeen[key]
+		if seen == nil {
+			seen = make(map[string]bool)
+			limits.valuesSeen[key] = seen
+		}
+		if !seen[value] {
+			if len(seen) >= cfg.labelMaxValues {
+				if !limits.overflowLogged[key] {
+					logger.Info("Label values over the cap bucketed into other",
+						zap.String("label_type", labelType),
+						zap.Int("max_values", cfg.labelMaxValues))
+					limits.overflowLogged[key] = true
+				}
+				return overflow
+			}
+			seen[value] = true
+		}
+	}
+
+	return value
+}
+
+// Метки, которые экспортируются в Prometheus
+var usefulLabels = map[string]bool{
+	"epic":     true,
+	"feature":  true,
+	"story":    true,
+	"severity": true,
+	"owner":    true,
+	"layer":    true,
+}
+
+// Определяет, нужно ли учитывать метку при экспорте в Prometheus
+func isUsefulLabel(name string) bool {
+	return usefulLabels[normalizeLabelName(name)]
+}
+
+// Метки с одним значением на тест, которые читаются через getLabelValue;
+// epic, feature и story бывают множественными и сюда не входят
+var singleValueLabels = map[string]bool{
+	"suite":    true,
+	"severity": true,
+	"owner":    true,
+	"layer":    true,
+}
+
+func isSingleValueLabel(name string) bool {
+	return singleValueLabels[name] || name == normalizeLabelName(cfg.envLabel)
+}
+
+// Некоторые адаптеры пишут имена меток с пробелами по краям или в другом регистре
+func normalizeLabelName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func healthCheck(w http.ResponseWriter, _ *http.Request) {
+	pausedUntil := time.Unix(0, atomic.LoadInt64(&healthPausedUntil))
+	stale := time.Since(time.Unix(0, atomic.LoadInt64(&lastParseTime))) > 5*time.Minute
+	if stale && time.Now().After(pausedUntil) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("UNHEALTHY: Data is stale"))
+		return
+	}
+
+	// Парсер работает по расписанию, но каждый цикл падает — опционально, чтобы не вызвать цикл перезапусков
+	if cfg.unhealthyOnErrors {
+		if failing := reportCollector.failing(cfg.maxParseErrors); len(failing) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("UNHEALTHY: Last parse failed"))
+			if failing[0] != "" {
+				fmt.Fprintf(w, " for projects %s", strings.Join(failing, ", "))
+			}
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+
+	// Пустой список тест-кейсов чаще означает неверный путь, чем пустой прогон
+	for _, project := range reportCollector.withoutTestCases() {
+		if project == "" {
+			w.Write([]byte("\nWARNING: Last cycle found zero test cases"))
+			continue
+		}
+		fmt.Fprintf(w, "\nWARNING: Last cycle found zero test cases in project %s", project)
+	}
+
+	if stale {
+		fmt.Fprintf(w, "\nWARNING: Data is stale, check paused until %s", pausedUntil.Format(time.RFC3339))
+	}
+}
+
+// Плановое обслуживание: на время паузы устаревшие данные не переводят /health
+// в 503 и не вызывают перезапусков; duration=0 снимает паузу досрочно
+func pauseHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil || duration < 0 {
+		http.Error(w, "duration must be a non-negative duration, e.g. 4h", http.StatusBadRequest)
+		return
+	}
+	if duration > cfg.maxHealthPause {
+		http.Error(w, fmt.Sprintf("duration exceeds -max-health-pause of %s", cfg.maxHealthPause), http.StatusBadRequest)
+		return
+	}
+
+	until := time.Now().Add(duration)
+	atomic.StoreInt64(&healthPausedUntil, until.UnixNano())
+	logger.Info("Health staleness check paused",
+		zap.Duration("duration", duration),
+		zap.Time("until", until))
+	fmt.Fprintf(w, "Staleness check paused until %s\n", until.Format(time.RFC3339))
+}
+
+// Пока отчет не сгенерирован, парсинг проходит с пустым summary; готовность
+// ждет непустого отчета, чтобы не отдавать нули на холодном старте
+func readyCheck(w http.ResponseWriter, _ *http.Request) {
+	if !reportCollector.ready(cfg.minTestsReady) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("NOT READY: No parsed report with enough tests"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("READY"))
+}
+
+// Представление метрик для /dump
+type (
+	dumpFamily struct {
+		Name    string       `json:"name"`
+		Help    string       `json:"help"`
+		Type    string       `json:"type"`
+		Metrics []dumpMetric `json:"metrics"`
+	}
+
+	dumpMetric struct {
+		Labels  map[string]string `json:"labels,omitempty"`
+		Value   *float64          `json:"value,omitempty"`
+		Count   *uint64           `json:"count,omitempty"`
+		Sum     *float64          `json:"sum,omitempty"`
+		Buckets map[string]uint64 `json:"buckets,omitempty"`
+	}
+)
+
+// Отдает текущее состояние реестра в JSON для потребителей без Prometheus
+func dumpMetrics(w http.ResponseWriter, _ *http.Request) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		logger.Error("Metrics gather failed", zap.Error(err))
+		http.Error(w, "metrics gather failed", http.StatusInternalServerError)
+		return
+	}
+
+	dump := make([]dumpFamily, 0, len(families))
+	for _, mf := range families {
+		family := dumpFamily{
+			Name:    mf.GetName(),
+			Help:    mf.GetHelp(),
+			Type:    strings.ToLower(mf.GetType().String()),
+			Metrics: make([]dumpMetric, 0, len(mf.GetMetric())),
+		}
+		for _, m := range mf.GetMetric() {
+			family.Metrics = append(family.Metrics, convertDumpMetric(m))
+		}
+		dump = append(dump, family)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dump); err != nil {
+		logger.Warn("Metrics dump write failed", zap.Error(err))
+	}
+}
+
+func convertDumpMetric(m *dto.Metric) dumpMetric {
+	var dm dumpMetric
+	if len(m.GetLabel()) > 0 {
+		dm.Labels = make(map[string]string, len(m.GetLabel()))
+		for _, lp := range m.GetLabel() {
+			dm.Labels[lp.GetName()] = lp.GetValue()
+		}
+	}
+
+	switch {
+	case m.Gauge != nil:
+		v := m.GetGauge().GetValue()
+		dm.Value = &v
+	case m.Counter != nil:
+		v := m.GetCounter().GetValue()
+		dm.Value = &v
+	case m.Untyped != nil:
+		v := m.GetUntyped().GetValue()
+		dm.Value = &v
+	case m.Histogram != nil:
+		h := m.GetHistogram()
+		count, sum := h.GetSampleCount(), h.GetSampleSum()
+		dm.Count, dm.Sum = &count, &sum
+		dm.Buckets = make(map[string]uint64, len(h.GetBucket()))
+		for _, b := range h.GetBucket() {
+			dm.Buckets[strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)] = b.GetCumulativeCount()
+		}
+	case m.Summary != nil:
+		s := m.GetSummary()
+		count, sum := s.GetSampleCount(), s.GetSampleSum()
+		dm.Count, dm.Sum = &count, &sum
+	}
+
+	return dm
 }
@@ -0,0 +1,961 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMain(m *testing.M) {
+	logger = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// Настройки как после запуска с флагами args; прежние восстанавливаются после теста
+func setupConfig(t testing.TB, args ...string) {
+	t.Helper()
+	savedCfg, savedArgs, savedFlags := cfg, os.Args, flag.CommandLine
+	t.Cleanup(func() {
+		cfg, os.Args, flag.CommandLine = savedCfg, savedArgs, savedFlags
+	})
+
+	cfg = config{}
+	flag.CommandLine = flag.NewFlagSet("allure-parser", flag.ContinueOnError)
+	os.Args = append([]string{"allure-parser"}, args...)
+	if err := parseFlags(); err != nil {
+		t.Fatalf("parse flags %v: %v", args, err)
+	}
+}
+
+// Разбирает отчет из директории и возвращает опубликованный снимок
+func parseDir(t *testing.T, dir string) (*ReportSnapshot, error) {
+	t.Helper()
+	resetCollector(t)
+	src := &reportSource{location: dir, fsys: os.DirFS(dir)}
+	err := parseAllureReports(src)
+	return reportCollector.snapshot(""), err
+}
+
+// Снимки прошлых тестов не должны попадать в следующие
+func resetCollector(t testing.TB) {
+	t.Helper()
+	reportCollector.mu.Lock()
+	reportCollector.reports = make(map[string]*publishedReport)
+	reportCollector.errors = make(map[string]string)
+	reportCollector.mu.Unlock()
+}
+
+// Тест-кейс из JSON в формате data/test-cases/*.json, как после чтения файла
+func testCase(t *testing.T, raw string) *AllureTestCase {
+	t.Helper()
+	var tc AllureTestCase
+	if err := json.Unmarshal([]byte(raw), &tc); err != nil {
+		t.Fatalf("unmarshal test case: %v", err)
+	}
+	tc.normalizeStatuses()
+	return &tc
+}
+
+// Снимок из тест-кейсов, учтенных так же, как при чтении отчета
+func snapshotOf(testCases ...*AllureTestCase) *ReportSnapshot {
+	snap := &ReportSnapshot{Summary: &AllureSummary{}}
+	for _, tc := range testCases {
+		snap.addTestCase(tc, "")
+	}
+	return snap
+}
+
+// Число тест-кейсов, учтенных в метриках снимка
+func keptTestCases(snap *ReportSnapshot) int {
+	kept := 0
+	for _, suite := range snap.Suites {
+		kept += suite.Total
+	}
+	return kept
+}
+
+func TestUnknownStatusMetrics(t *testing.T) {
+	setupConfig(t)
+
+	tests := []struct {
+		name    string
+		raw     string
+		unknown map[string]float64
+	}{
+		{name: "passed", raw: `{"name":"a","status":"passed"}`, unknown: map[string]float64{}},
+		{name: "skipped", raw: `{"name":"a","status":"skipped"}`, unknown: map[string]float64{}},
+		{name: "pending", raw: `{"name":"a","status":"pending"}`, unknown: map[string]float64{"pending": 1}},
+		{name: "upper case", raw: `{"name":"a","status":"PENDING"}`, unknown: map[string]float64{"pending": 1}},
+		{name: "empty", raw: `{"name":"a","status":""}`, unknown: map[string]float64{"unknown": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snap := snapshotOf(testCase(t, tt.raw))
+			m := buildReportMetrics(snap)
+
+			if got := testutil.CollectAndCount(m.unknownStatus); got != len(tt.unknown) {
+				t.Fatalf("allure_tests_unknown_status_total has %d series, want %d", got, len(tt.unknown))
+			}
+			for status, want := range tt.unknown {
+				if got := testutil.ToFloat64(m.unknownStatus.WithLabelValues(status)); got != want {
+					t.Errorf("allure_tests_unknown_status_total{status=%q} = %v, want %v", status, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReportWithoutHistory(t *testing.T) {
+	setupConfig(t)
+
+	snap, err := parseDir(t, filepath.Join("testdata", "no-history"))
+	if err != nil {
+		t.Fatalf("parse report without history: %v", err)
+	}
+	if snap == nil || snap.Summary == nil {
+		t.Fatal("no summary published for report without history")
+	}
+	if snap.History != nil {
+		t.Errorf("history = %+v, want none", snap.History)
+	}
+
+	m := buildReportMetrics(snap)
+	if got := testutil.ToFloat64(m.historyAvailable); got != 0 {
+		t.Errorf("allure_history_available = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(m.flakyRatio); got != 0 {
+		t.Errorf("allure_flaky_tests_ratio = %v, want 0", got)
+	}
+	if got := testutil.CollectAndCount(m.historyTrend); got != 0 {
+		t.Errorf("allure_history_trend has %d series, want none", got)
+	}
+}
+
+// Без failed отношение broken к failed не определено и не должно выдавать
+// число broken за отношение
+func TestBrokenToFailedRatio(t *testing.T) {
+	setupConfig(t)
+
+	for _, tt := range []struct {
+		failed, broken int
+		want           float64
+	}{
+		{failed: 0, broken: 5, want: 0},
+		{failed: 4, broken: 2, want: 0.5},
+	} {
+		var summary AllureSummary
+		summary.Statistic.Failed = tt.failed
+		summary.Statistic.Broken = tt.broken
+
+		m := newReportMetrics()
+		updateSummaryMetrics(m, &summary)
+		if got := testutil.ToFloat64(m.brokenToFailed); got != tt.want {
+			t.Errorf("failed=%d broken=%d: allure_broken_failed_ratio = %v, want %v", tt.failed, tt.broken, got, tt.want)
+		}
+	}
+}
+
+// Сбойный цикл не должен закреплять свой снимок за отчетом, который после
+// восстановления побайтно совпадает с последним успешным
+func TestSkipUnchangedAfterFailedCycle(t *testing.T) {
+	setupConfig(t, "-skip-unchanged")
+	resetCollector(t)
+
+	dir := t.TempDir()
+	if err := os.CopyFS(dir, os.DirFS(filepath.Join("testdata", "no-history"))); err != nil {
+		t.Fatal(err)
+	}
+	summaryFile := filepath.Join(dir, "widgets", "summary.json")
+	summary, err := os.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &reportSource{location: dir, fsys: os.DirFS(dir)}
+
+	cycles := []struct {
+		name     string
+		summary  []byte
+		wantErr  bool
+		wantTest bool
+	}{
+		{name: "good", summary: summary, wantTest: true},
+		{name: "broken", summary: []byte("{"), wantErr: true},
+		{name: "restored", summary: summary, wantTest: true},
+		{name: "unchanged", summary: summary, wantTest: true},
+	}
+	for _, cycle := range cycles {
+		if err := os.WriteFile(summaryFile, cycle.summary, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err := parseAllureReports(src)
+		if (err != nil) != cycle.wantErr {
+			t.Fatalf("%s cycle: error = %v, want error %v", cycle.name, err, cycle.wantErr)
+		}
+
+		snap := reportCollector.snapshot("")
+		if snap == nil {
+			t.Fatalf("%s cycle: nothing published", cycle.name)
+		}
+		if got := snap.Summary != nil; got != cycle.wantTest {
+			t.Fatalf("%s cycle: summary published = %v, want %v", cycle.name, got, cycle.wantTest)
+		}
+		if !cycle.wantTest {
+			continue
+		}
+		m := buildReportMetrics(snap)
+		if got := testutil.ToFloat64(m.testsTotal.WithLabelValues("passed")); got != 1 {
+			t.Errorf("%s cycle: allure_tests_total{status=\"passed\"} = %v, want 1", cycle.name, got)
+		}
+	}
+	if src.fingerprint == "" || src.fingerprint != reportFingerprint(os.DirFS(dir)) {
+		t.Errorf("fingerprint of the restored report is not remembered")
+	}
+}
+
+// С -since неизменный отчет все равно разбирается: тесты, вышедшие из окна,
+// пропадают из метрик, а не остаются в снимке первого цикла
+// Отчет, отброшенный -require-complete, не должен сдвигать хэш окружения:
+// иначе смена окружения в следующем опубликованном снимке теряется
+func TestEnvironmentChangeAfterIncompleteReport(t *testing.T) {
+	setupConfig(t, "-require-complete")
+	resetCollector(t)
+
+	dir := t.TempDir()
+	if err := os.CopyFS(dir, os.DirFS(filepath.Join("testdata", "no-history"))); err != nil {
+		t.Fatal(err)
+	}
+	summaryFile := filepath.Join(dir, "widgets", "summary.json")
+	summary, err := os.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &reportSource{location: dir, fsys: os.DirFS(dir)}
+
+	cycles := []struct {
+		name        string
+		env         string
+		summary     []byte
+		wantChanged bool
+	}{
+		{name: "first", env: `{"stand":"a"}`, summary: summary},
+		{name: "incomplete", env: `{"stand":"b"}`, summary: []byte(`{"statistic":{"passed":100}}`)},
+		{name: "complete", env: `{"stand":"b"}`, summary: summary, wantChanged: true},
+		{name: "same", env: `{"stand":"b"}`, summary: summary},
+	}
+	for _, cycle := range cycles {
+		if err := os.WriteFile(filepath.Join(dir, "environment.json"), []byte(cycle.env), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(summaryFile, cycle.summary, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := parseAllureReports(src); err != nil {
+			t.Fatalf("%s cycle: %v", cycle.name, err)
+		}
+
+		snap := reportCollector.snapshot("")
+		if cycle.name == "incomplete" {
+			if snap.Environment["stand"] != "a" {
+				t.Fatalf("incomplete cycle published environment %v", snap.Environment)
+			}
+			continue
+		}
+		if snap.EnvChanged != cycle.wantChanged {
+			t.Errorf("%s cycle: environment changed = %v, want %v", cycle.name, snap.EnvChanged, cycle.wantChanged)
+		}
+	}
+}
+
+func TestSinceDisablesSkipUnchanged(t *testing.T) {
+	setupConfig(t, "-skip-unchanged", "-since", "500ms")
+	resetCollector(t)
+
+	dir := t.TempDir()
+	if err := os.CopyFS(dir, os.DirFS(filepath.Join("testdata", "no-history"))); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UnixMilli()
+	login := fmt.Sprintf(`{"uuid":"login","name":"login","status":"passed","start":%d,"stop":%d}`, start, start+100)
+	if err := os.WriteFile(filepath.Join(dir, "data", "test-cases", "login.json"), []byte(login), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src := &reportSource{location: dir, fsys: os.DirFS(dir)}
+
+	// logout.json начат в 2023 году и сразу вне окна
+	for _, want := range []struct{ kept, tooOld int }{{1, 1}, {0, 2}} {
+		if err := parseAllureReports(src); err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		snap := reportCollector.snapshot("")
+		if kept := keptTestCases(snap); kept != want.kept || snap.TooOld != want.tooOld {
+			t.Errorf("test cases kept %d, too old %d; want %d and %d", kept, snap.TooOld, want.kept, want.tooOld)
+		}
+		time.Sleep(600 * time.Millisecond)
+	}
+}
+
+// Перекрывающиеся циклы (тикер, /reload, сигнал) идут по очереди, и скрейп
+// во время разбора видит целый снимок. Запускать с -race
+func TestConcurrentParses(t *testing.T) {
+	setupConfig(t)
+	resetCollector(t)
+	dir := filepath.Join("testdata", "no-history")
+	src := &reportSource{location: dir, fsys: os.DirFS(dir)}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- parseSources(src)
+		}()
+		go func() {
+			defer wg.Done()
+			testutil.CollectAndCount(reportCollector)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("overlapping parse failed: %v", err)
+		}
+	}
+	snap := reportCollector.snapshot("")
+	if snap == nil || snap.Summary == nil {
+		t.Fatal("no snapshot published")
+	}
+	if snap.Summary.total() != 2 || snap.TestCasesFound != 2 || keptTestCases(snap) != 2 {
+		t.Errorf("inconsistent snapshot: summary total %d, test cases found %d, kept %d",
+			snap.Summary.total(), snap.TestCasesFound, keptTestCases(snap))
+	}
+}
+
+func TestReadErrorTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "not found", err: readError("widgets/summary.json", fs.ErrNotExist),
+			want: "file not found: widgets/summary.json: file does not exist"},
+		{name: "malformed", err: &ErrMalformedJSON{File: "widgets/summary.json", Err: errors.New("unexpected EOF")},
+			want: "malformed json in widgets/summary.json: unexpected EOF"},
+		{name: "missing field", err: &ErrMissingField{File: "widgets/summary.json", Field: "statistic"},
+			want: `widgets/summary.json has no "statistic" field`},
+		{name: "other read error", err: readError("widgets/summary.json", fs.ErrPermission),
+			want: "read file: permission denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.want {
+				t.Errorf("error = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	var notFound *ErrFileNotFound
+	if err := readError("widgets/summary.json", fs.ErrNotExist); !errors.As(err, &notFound) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("readError(ErrNotExist) = %#v, want *ErrFileNotFound wrapping fs.ErrNotExist", err)
+	}
+}
+
+func TestReadStage(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "widgets/summary.json", want: "summary"},
+		{name: "widgets/summary-2.json", want: "summary"},
+		{name: "widgets/environment.json", want: "environment"},
+		{name: "environment.xml", want: "environment"},
+		{name: "executor.json", want: "executor"},
+		{name: "history/history-trend.json", want: "history"},
+		{name: "widgets/packages.json", want: "packages"},
+		{name: "8c1f-container.json", want: "container"},
+		{name: "cart-testsuite.xml", want: "allure1_xml"},
+		{name: "index.html", want: "format"},
+		{name: "data/test-cases/login.json", want: "test_case"},
+	}
+	for _, tt := range tests {
+		if got := readStage(tt.name); got != tt.want {
+			t.Errorf("readStage(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDetectFormatVersion(t *testing.T) {
+	setupConfig(t)
+
+	tests := []struct {
+		name   string
+		source fstest.MapFS
+		want   string
+	}{
+		{
+			name: "index generator",
+			source: fstest.MapFS{
+				"index.html":           {Data: []byte(`<html><head><meta name="generator" content="Allure Report 2.29.0"></head></html>`)},
+				"widgets/summary.json": {Data: []byte(`{"statistic":{}}`)},
+			},
+			want: "2.29.0",
+		},
+		{
+			name: "summary generator",
+			source: fstest.MapFS{
+				"widgets/summary.json": {Data: []byte(`{"generator":"allure-report 3.0.0","statistic":{}}`)},
+			},
+			want: "3.0.0",
+		},
+		{
+			name: "summary version",
+			source: fstest.MapFS{
+				"widgets/summary.json": {Data: []byte(`{"version":"2.24.1","statistic":{}}`)},
+			},
+			want: "2.24.1",
+		},
+		{
+			name: "no version fields",
+			source: fstest.MapFS{
+				"index.html":           {Data: []byte(`<html><head><title>Allure Report</title></head></html>`)},
+				"widgets/summary.json": {Data: []byte(`{"statistic":{}}`)},
+			},
+			want: "unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectFormatVersion(tt.source); got != tt.want {
+				t.Errorf("format version = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusAliases(t *testing.T) {
+	setupConfig(t, "-status-alias", "success=passed,error=broken,Ignored=skipped")
+
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{status: "success", want: "passed"},
+		{status: "SUCCESS", want: "passed"},
+		{status: "error", want: "broken"},
+		{status: "Error", want: "broken"},
+		// Ключ алиаса тоже приводится к нижнему регистру
+		{status: "ignored", want: "skipped"},
+		// Статусы без алиаса только приводятся к нижнему регистру
+		{status: "Failed", want: "failed"},
+		{status: "pending", want: "pending"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			if got := normalizeStatus(tt.status); got != tt.want {
+				t.Errorf("normalizeStatus(%q) = %q, want %q", tt.status, got, tt.want)
+			}
+		})
+	}
+
+	// Алиасы применяются и к вложенным шагам
+	tc := testCase(t, `{"name":"a","status":"success","steps":[{"name":"s","status":"error","steps":[{"name":"n","status":"success"}]}]}`)
+	if tc.Status != "passed" || tc.Steps[0].Status != "broken" || tc.Steps[0].Steps[0].Status != "passed" {
+		t.Errorf("statuses = %s, %s, %s; want passed, broken, passed",
+			tc.Status, tc.Steps[0].Status, tc.Steps[0].Steps[0].Status)
+	}
+	m := buildReportMetrics(snapshotOf(tc))
+	if got := testutil.CollectAndCount(m.unknownStatus); got != 0 {
+		t.Errorf("allure_tests_unknown_status_total has %d series after aliasing, want none", got)
+	}
+}
+
+func TestHasScreenshot(t *testing.T) {
+	setupConfig(t, "-screenshot-types", "image/png,image/jpeg")
+
+	tests := []struct {
+		name string
+		raw  string
+		want bool
+	}{
+		{name: "no attachments", raw: `{"status":"failed","steps":[{"name":"s"}]}`},
+		{name: "test attachment", raw: `{"status":"failed","attachments":[{"type":"image/png"}]}`, want: true},
+		{name: "top-level step", raw: `{"status":"failed","steps":[{"attachments":[{"type":"image/jpeg"}]}]}`, want: true},
+		{name: "nested step", raw: `{"status":"failed","steps":[{"steps":[{"steps":[{"attachments":[{"type":"IMAGE/PNG"}]}]}]}]}`, want: true},
+		{name: "nested non-screenshot", raw: `{"status":"failed","steps":[{"steps":[{"attachments":[{"type":"text/plain"}]}]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := testCase(t, tt.raw)
+			if got := hasScreenshot(tc); got != tt.want {
+				t.Errorf("hasScreenshot = %v, want %v", got, tt.want)
+			}
+			m := buildReportMetrics(snapshotOf(tc))
+			want := 1.0
+			if tt.want {
+				want = 0
+			}
+			if got := testutil.ToFloat64(m.noScreenshot); got != want {
+				t.Errorf("allure_failed_without_screenshot_total = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// Имя метки приводится к одному виду: пробелы и регистр не дробят серии
+func TestTestsByLabelNormalizesNames(t *testing.T) {
+	setupConfig(t, "-label-allow", "Severity=critical")
+
+	snap := snapshotOf(
+		testCase(t, `{"name":"a","status":"passed","labels":[{"name":" Severity ","value":"critical"}]}`),
+		testCase(t, `{"name":"b","status":"passed","labels":[{"name":"severity","value":"critical"}]}`),
+		testCase(t, `{"name":"c","status":"passed","labels":[{"name":"SEVERITY","value":"minor"}]}`),
+	)
+	m := buildReportMetrics(snap)
+
+	if got := testutil.CollectAndCount(m.testsByLabel); got != 2 {
+		t.Errorf("allure_tests_by_label has %d series, want 2", got)
+	}
+	if got := testutil.ToFloat64(m.testsByLabel.WithLabelValues("severity", "critical")); got != 2 {
+		t.Errorf(`allure_tests_by_label{label_type="severity",label_value="critical"} = %v, want 2`, got)
+	}
+	// minor не входит в -label-allow, заданный для Severity
+	if got := testutil.ToFloat64(m.testsByLabel.WithLabelValues("severity", "other")); got != 1 {
+		t.Errorf(`allure_tests_by_label{label_type="severity",label_value="other"} = %v, want 1`, got)
+	}
+	if got := m.testsWithLabel["severity"]; got != 3 {
+		t.Errorf("tests with severity label = %d, want 3", got)
+	}
+}
+
+// Два цикла по манифесту одновременно: перечитывание манифеста и разбор
+// проектов идут по очереди. Запускать с -race
+func TestConcurrentManifestParses(t *testing.T) {
+	savedSources := manifestSources
+	t.Cleanup(func() { manifestSources = savedSources })
+	manifestSources = make(map[string]*reportSource)
+
+	manifest := filepath.Join(t.TempDir(), "manifest.json")
+	entries := fmt.Sprintf(`[{"name":"auth","path":%q},{"name":"orders","path":%q}]`,
+		filepath.Join("testdata", "no-history"), filepath.Join("testdata", "duplicate-uuid"))
+	if err := os.WriteFile(manifest, []byte(entries), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setupConfig(t, "-manifest", manifest)
+	resetCollector(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- parseSources(nil)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("manifest parse failed: %v", err)
+		}
+	}
+	snaps := reportCollector.snapshots()
+	if len(snaps) != 2 || snaps["auth"] == nil || snaps["orders"] == nil {
+		t.Fatalf("published projects = %v, want auth and orders", snaps)
+	}
+	if got := keptTestCases(snaps["orders"]); got != 3 {
+		t.Errorf("orders test cases = %d, want 3", got)
+	}
+	if len(manifestSources) != 2 {
+		t.Errorf("manifest sources = %d, want 2", len(manifestSources))
+	}
+}
+
+// Сырые allure-results без summary: считаются только контейнеры, цикл не падает.
+// В сгенерированном отчете проверка контейнеров не выполняется
+func TestOrphanedContainers(t *testing.T) {
+	setupConfig(t)
+
+	snap, err := parseDir(t, filepath.Join("testdata", "raw-results"))
+	if err != nil {
+		t.Fatalf("parse raw results: %v", err)
+	}
+	if snap.OrphanedFiles != 1 {
+		t.Errorf("orphaned files = %d, want 1", snap.OrphanedFiles)
+	}
+	if snap.Stages["containers"] != "ok" {
+		t.Errorf("containers stage = %q, want ok", snap.Stages["containers"])
+	}
+	if _, ok := snap.Stages["summary"]; ok || snap.Summary != nil {
+		t.Errorf("summary parsed for raw results: stage %q", snap.Stages["summary"])
+	}
+	if got := testutil.ToFloat64(buildReportMetrics(snap).orphanedFiles); got != 1 {
+		t.Errorf("allure_orphaned_files_total = %v, want 1", got)
+	}
+
+	snap, err = parseDir(t, filepath.Join("testdata", "no-history"))
+	if err != nil {
+		t.Fatalf("parse generated report: %v", err)
+	}
+	if _, ok := snap.Stages["containers"]; ok || snap.OrphanedFiles != 0 {
+		t.Errorf("containers checked in generated report: stage %q, orphaned %d", snap.Stages["containers"], snap.OrphanedFiles)
+	}
+}
+
+// Сырые allure-results без summary не делают проект больным или неготовым
+// и проходят проверку -exit-on-failures с вердиктом RAW
+func TestRawResultsHealth(t *testing.T) {
+	setupConfig(t, "-interval", "0", "-exit-on-failures", "0")
+
+	snap, err := parseDir(t, filepath.Join("testdata", "raw-results"))
+	if err != nil {
+		t.Fatalf("parse raw results: %v", err)
+	}
+	if !snap.Raw {
+		t.Fatal("raw results snapshot is not marked raw")
+	}
+	if failing := reportCollector.failing(0); len(failing) != 0 {
+		t.Errorf("failing projects = %v, want none", failing)
+	}
+	if !reportCollector.ready(1) {
+		t.Error("collector is not ready with raw results")
+	}
+
+	var out bytes.Buffer
+	if code := checkFailures(&out); code != 0 {
+		t.Errorf("exit code = %d, want 0; output %q", code, out.String())
+	}
+	if !strings.Contains(out.String(), "RAW") {
+		t.Errorf("output %q has no RAW verdict", out.String())
+	}
+
+	// Без summary и без признака сырых результатов проект по-прежнему больной
+	snap, _ = parseDir(t, t.TempDir())
+	if snap.Raw {
+		t.Error("empty directory marked raw")
+	}
+	if failing := reportCollector.failing(0); len(failing) != 1 {
+		t.Errorf("failing projects = %v, want the empty project", failing)
+	}
+}
+
+// Слишком длинная строка потока пропускается как одна ошибка разбора, а
+// чтение продолжается со следующей строки
+func TestStreamLineTooLong(t *testing.T) {
+	setupConfig(t, "-max-file-size", "1000")
+
+	long := `{"name":"huge","status":"passed","description":"` + strings.Repeat("x", 100<<10) + `"}`
+	stream := strings.Join([]string{
+		`{"name":"first","status":"passed"}`,
+		long,
+		`{"name":"second","status":"failed"}`,
+		`{"name":"last","status":"passed"}`,
+	}, "\n")
+	source := fstest.MapFS{"test-cases.jsonl": {Data: []byte(stream)}}
+
+	snap := snapshotOf()
+	if err := parseTestCaseStream(source, "test-cases.jsonl", snap); err != nil {
+		t.Fatalf("parse stream: %v", err)
+	}
+	if snap.ParseErrors != 1 {
+		t.Errorf("parse errors = %d, want 1", snap.ParseErrors)
+	}
+	if kept := keptTestCases(snap); kept != 3 {
+		t.Errorf("test cases = %d, want 3", kept)
+	}
+}
+
+// Адаптер не записал start/stop теста: длительность берется от самого раннего
+// старта до самого позднего окончания шагов, включая вложенные
+func TestDurationFromSteps(t *testing.T) {
+	setupConfig(t)
+
+	snap, err := parseDir(t, filepath.Join("testdata", "step-times"))
+	if err != nil {
+		t.Fatalf("parse report: %v", err)
+	}
+	if suite := snap.Suites["cart"]; suite == nil || suite.Total != 1 || suite.DurationSeconds != 8 {
+		t.Fatalf("suite cart = %+v, want one test of 8 seconds", suite)
+	}
+	if want := time.UnixMilli(1700000001000); !snap.LastTestStart.Equal(want) {
+		t.Errorf("last test start = %v, want %v", snap.LastTestStart, want)
+	}
+	m := buildReportMetrics(snap)
+	if got := testutil.ToFloat64(m.testDuration.WithLabelValues("checkout", "cart", "unknown")); got != 8 {
+		t.Errorf(`allure_test_duration_seconds{name="checkout"} = %v, want 8`, got)
+	}
+}
+
+func TestDuplicateUUIDs(t *testing.T) {
+	setupConfig(t)
+	core, logs := observer.New(zap.DebugLevel)
+	savedLogger := logger
+	logger = zap.New(core)
+	t.Cleanup(func() { logger = savedLogger })
+
+	snap, err := parseDir(t, filepath.Join("testdata", "duplicate-uuid"))
+	if err != nil {
+		t.Fatalf("parse report: %v", err)
+	}
+	if snap.DuplicateUUIDs != 1 {
+		t.Errorf("duplicate uuids = %d, want 1", snap.DuplicateUUIDs)
+	}
+	if got := testutil.ToFloat64(buildReportMetrics(snap).duplicateUUIDs); got != 1 {
+		t.Errorf("allure_duplicate_uuid_total = %v, want 1", got)
+	}
+
+	// Файлы читаются в порядке имен: первым считается login-merged.json,
+	// второй файл с тем же uuid — повтором. Оба тест-кейса остаются в отчете
+	duplicates := logs.FilterMessage("Duplicate test case uuid").AllUntimed()
+	if len(duplicates) != 1 {
+		t.Fatalf("duplicate uuid log entries = %d, want 1", len(duplicates))
+	}
+	fields := duplicates[0].ContextMap()
+	if fields["file"] != "data/test-cases/login.json" || fields["first_file"] != "data/test-cases/login-merged.json" {
+		t.Errorf("duplicate logged for %v after %v, want data/test-cases/login.json after data/test-cases/login-merged.json",
+			fields["file"], fields["first_file"])
+	}
+	if kept := keptTestCases(snap); kept != 3 {
+		t.Errorf("test cases kept = %d, want 3", kept)
+	}
+}
+
+// Снимок с одним тестом в каждом из сьютов; длительность теста 2 секунды
+func suitesSnapshot(t *testing.T, suites ...string) *ReportSnapshot {
+	t.Helper()
+	var testCases []*AllureTestCase
+	for _, suite := range suites {
+		testCases = append(testCases, testCase(t, `{"name":"`+suite+` test","status":"passed","start":1000,"stop":3000,`+
+			`"labels":[{"name":"suite","value":"`+suite+`"}]}`))
+	}
+	return snapshotOf(testCases...)
+}
+
+// Серии коллектора в виде имя{метки} со значением; берутся только gauge
+func collectSeries(c prometheus.Collector) (map[string]float64, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		return nil, err
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.Gauge == nil {
+				continue
+			}
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetName()+"="+strconv.Quote(label.GetValue()))
+			}
+			series[family.GetName()+"{"+strings.Join(labels, ",")+"}"] = metric.GetGauge().GetValue()
+		}
+	}
+	return series, nil
+}
+
+// После подмены снимка в выдаче нет серий прошлого отчета
+func TestCollectorSwapDropsOldSeries(t *testing.T) {
+	setupConfig(t)
+	collector := &snapshotCollector{reports: make(map[string]*publishedReport), errors: make(map[string]string)}
+
+	collector.publish("app", suitesSnapshot(t, "old"))
+	series, err := collectSeries(collector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := series[`allure_suite_avg_duration_seconds{project="app",suite="old"}`]; got != 2 {
+		t.Fatalf("old suite duration = %v, want 2", got)
+	}
+
+	collector.publish("app", suitesSnapshot(t, "new"))
+	series, err = collectSeries(collector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range series {
+		if strings.Contains(key, `suite="old"`) {
+			t.Errorf("series %s of the previous report still exported", key)
+		}
+	}
+	if _, ok := series[`allure_suite_avg_duration_seconds{project="app",suite="new"}`]; !ok {
+		t.Error("new suite series missing")
+	}
+}
+
+// Скрейп во время публикации видит один из снимков целиком, а не смесь двух
+func TestCollectorScrapeDuringPublish(t *testing.T) {
+	setupConfig(t)
+	collector := &snapshotCollector{reports: make(map[string]*publishedReport), errors: make(map[string]string)}
+
+	const publishes = 200
+	snaps := make([]*ReportSnapshot, publishes)
+	for i := range snaps {
+		if i%2 == 0 {
+			snaps[i] = suitesSnapshot(t, "even-a", "even-b")
+		} else {
+			snaps[i] = suitesSnapshot(t, "odd-a", "odd-b")
+		}
+	}
+	collector.publish("", snaps[0])
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, snap := range snaps[1:] {
+			collector.publish("", snap)
+		}
+	}()
+
+	for scraping := true; scraping; {
+		select {
+		case <-done:
+			scraping = false
+		default:
+		}
+
+		series, err := collectSeries(collector)
+		if err != nil {
+			t.Fatalf("scrape: %v", err)
+		}
+		var even, odd int
+		for key := range series {
+			if !strings.HasPrefix(key, "allure_suite_avg_duration_seconds{") {
+				continue
+			}
+			if strings.Contains(key, `suite="even-`) {
+				even++
+			} else {
+				odd++
+			}
+		}
+		if !(even == 2 && odd == 0) && !(even == 0 && odd == 2) {
+			t.Fatalf("scrape mixed snapshots: %d even and %d odd suite series", even, odd)
+		}
+	}
+}
+
+// Серия, пропавшая из нового отчета: none оставляет прошлое значение,
+// decay — ноль, full убирает серию
+func TestResetModes(t *testing.T) {
+	const gone = `allure_suite_avg_duration_seconds{suite="gone"}`
+	tests := []struct {
+		mode      string
+		wantValue float64
+		wantKept  bool
+	}{
+		{mode: "none", wantValue: 2, wantKept: true},
+		{mode: "decay", wantValue: 0, wantKept: true},
+		{mode: "full"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			setupConfig(t, "-reset-mode", tt.mode)
+			collector := &snapshotCollector{reports: make(map[string]*publishedReport), errors: make(map[string]string)}
+
+			collector.publish("", suitesSnapshot(t, "kept", "gone"))
+			if _, err := collectSeries(collector); err != nil {
+				t.Fatal(err)
+			}
+			collector.publish("", suitesSnapshot(t, "kept"))
+
+			series, err := collectSeries(collector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, kept := series[gone]
+			if kept != tt.wantKept || value != tt.wantValue {
+				t.Errorf("%s = %v (present %v), want %v (present %v)", gone, value, kept, tt.wantValue, tt.wantKept)
+			}
+			if got := series[`allure_suite_avg_duration_seconds{suite="kept"}`]; got != 2 {
+				t.Errorf("kept suite duration = %v, want 2", got)
+			}
+		})
+	}
+}
+
+// Отчет из n тест-кейсов с именами из одного набора в 200 тестов, как у
+// повторяющихся прогонов параметризованных тестов
+func writeLargeReport(b *testing.B, n int) *reportSource {
+	b.Helper()
+	dir := b.TempDir()
+	writeFile := func(name, data string) {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	writeFile("widgets/summary.json", fmt.Sprintf(`{"statistic":{"passed":%d,"failed":0,"broken":0,"skipped":0}}`, n))
+	for i := 0; i < n; i++ {
+		writeFile(fmt.Sprintf("data/test-cases/%06d.json", i), fmt.Sprintf(
+			`{"uuid":"%[1]d","name":"test %[2]d","status":"passed","start":1700000000000,"stop":1700000001000,`+
+				`"labels":[{"name":"suite","value":"suite %[3]d"},{"name":"severity","value":"normal"}],`+
+				`"steps":[{"name":"step","status":"passed","start":1700000000000,"stop":1700000000500}]}`, i, i%200, i%50))
+	}
+	return &reportSource{location: dir, fsys: os.DirFS(dir)}
+}
+
+// Куча после разбора отчета и сборки метрик, пока снимок опубликован
+func retainedHeap(b *testing.B, src *reportSource) uint64 {
+	b.Helper()
+	resetCollector(b)
+	if err := parseAllureReports(src); err != nil {
+		b.Fatal(err)
+	}
+	testutil.CollectAndCount(reportCollector)
+
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return mem.HeapAlloc
+}
+
+// Снимок хранит метрики, а не тест-кейсы: куча после отчета в 10 раз больше
+// почти не растет, пока набор имен тестов тот же
+func BenchmarkParseLargeReport(b *testing.B) {
+	setupConfig(b)
+	small, large := writeLargeReport(b, 2000), writeLargeReport(b, 20000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := parseAllureReports(large); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	smallHeap, largeHeap := retainedHeap(b, small), retainedHeap(b, large)
+	b.ReportMetric(float64(smallHeap), "heap-bytes-2k")
+	b.ReportMetric(float64(largeHeap), "heap-bytes-20k")
+	if largeHeap > smallHeap+smallHeap/4 {
+		b.Fatalf("heap grows with report size: %d bytes after 2000 test cases, %d after 20000", smallHeap, largeHeap)
+	}
+}
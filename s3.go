@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// Источник отчета в S3: объекты под s3://bucket/prefix читаются как файловая система
+type (
+	// Вызовы S3, которые использует s3FS; в тестах подменяется
+	s3API interface {
+		GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+		HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+		s3.ListObjectsV2APIClient
+	}
+
+	s3FS struct {
+		client s3API
+		bucket string
+		prefix string
+
+		// Кэш объектов по ключу при -cache-ttl > 0
+		cacheTTL time.Duration
+		cacheMu  sync.Mutex
+		cache    map[string]*s3CacheEntry
+	}
+
+	s3CacheEntry struct {
+		etag      string
+		data      []byte
+		modTime   time.Time
+		checkedAt time.Time
+		usedAt    time.Time
+	}
+
+	// Запоминает тело объекта, если его дочитали до конца
+	s3CachingBody struct {
+		body  io.ReadCloser
+		buf   bytes.Buffer
+		store func([]byte)
+	}
+
+	s3File struct {
+		body io.ReadCloser
+		info s3FileInfo
+	}
+
+	s3FileInfo struct {
+		name    string
+		size    int64
+		modTime time.Time
+		dir     bool
+	}
+)
+
+func newS3FS(ctx context.Context, location string) (*s3FS, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("parse s3 url: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("s3 url %q has no bucket", location)
+	}
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.caCert != "" || cfg.insecure {
+		tlsConfig, err := remoteTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, awsconfig.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.TLSClientConfig = tlsConfig
+		})))
+	}
+
+	// Учетные данные берутся из стандартной цепочки AWS (env, профиль, роль)
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("load aws config: %w", err)
+	}
+
+	return &s3FS{
+		client:   s3.NewFromConfig(awsCfg),
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		cacheTTL: cfg.cacheTTL,
+		cache:    make(map[string]*s3CacheEntry),
+	}, nil
+}
+
+// TLS для S3-совместимых хранилищ во внутренней PKI: системные корни плюс -ca-cert
+func remoteTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.insecure}
+	if cfg.caCert == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.caCert)
+	if err != nil {
+		return nil, fmt.Errorf("read ca cert: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.caCert)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+// Записи, к которым давно не обращались, относятся к файлам прошлых прогонов
+const s3CacheIdle = 10 * time.Minute
+
+func (s *s3FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if s.cacheTTL <= 0 {
+		out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key(name)),
+		})
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: s3Error(err)}
+		}
+		return newS3File(name, out.Body, aws.ToInt64(out.ContentLength), aws.ToTime(out.LastModified)), nil
+	}
+
+	return s.openCached(name)
+}
+
+// В пределах TTL объект отдается из памяти, после — перепроверяется по ETag,
+// и при 304 Not Modified повторно не скачивается
+func (s *s3FS) openCached(name string) (fs.File, error) {
+	key := s.key(name)
+	now := time.Now()
+
+	s.cacheMu.Lock()
+	entry := s.cache[key]
+	if entry != nil {
+		entry.usedAt = now
+		if now.Sub(entry.checkedAt) < s.cacheTTL {
+			s.cacheMu.Unlock()
+			return entry.file(name), nil
+		}
+	}
+	s.cacheMu.Unlock()
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if entry != nil {
+		input.IfNoneMatch = aws.String(entry.etag)
+	}
+
+	out, err := s.client.GetObject(context.Background(), input)
+	if entry != nil && isNotModified(err) {
+		s.cacheMu.Lock()
+		entry.checkedAt = now
+		s.cacheMu.Unlock()
+		return entry.file(name), nil
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: s3Error(err)}
+	}
+
+	etag, modTime := aws.ToString(out.ETag), aws.ToTime(out.LastModified)
+	body := &s3CachingBody{
+		body: out.Body,
+		store: func(data []byte) {
+			s.cacheMu.Lock()
+			defer s.cacheMu.Unlock()
+			s.cache[key] = &s3CacheEntry{etag: etag, data: data, modTime: modTime, checkedAt: now, usedAt: now}
+			for k, e := range s.cache {
+				if now.Sub(e.usedAt) > s3CacheIdle {
+					delete(s.cache, k)
+				}
+			}
+		},
+	}
+	return newS3File(name, body, aws.ToInt64(out.ContentLength), modTime), nil
+}
+
+func (s *s3FS) ReadFile(name string) ([]byte, error) {
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// Список "директории" строится по общим префиксам с разделителем "/"
+func (s *s3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	prefix := s.key(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var entries []fs.DirEntry
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: s3Error(err)}
+		}
+
+		for _, cp := range page.CommonPrefixes {
+			dirName := path.Base(strings.TrimSuffix(aws.ToString(cp.Prefix), "/"))
+			entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{name: dirName, dir: true}))
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if key == prefix {
+				continue
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{
+				name:    path.Base(key),
+				size:    aws.ToInt64(obj.Size),
+				modTime: aws.ToTime(obj.LastModified),
+			}))
+		}
+	}
+
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *s3FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return s3FileInfo{name: ".", dir: true}, nil
+	}
+	if s.cacheTTL > 0 {
+		if info, ok := s.statCached(name); ok {
+			return info, nil
+		}
+	}
+
+	out, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err == nil {
+		return s3FileInfo{
+			name:    path.Base(name),
+			size:    aws.ToInt64(out.ContentLength),
+			modTime: aws.ToTime(out.LastModified),
+		}, nil
+	}
+	if !errors.Is(s3Error(err), fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: s3Error(err)}
+	}
+
+	// Объекта нет, но это может быть "директория" с вложенными ключами
+	if _, err := s.ReadDir(name); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return s3FileInfo{name: path.Base(name), dir: true}, nil
+}
+
+// Сведения о закэшированном объекте: в пределах TTL без запросов, после —
+// HeadObject с If-None-Match, и при 304 запись считается проверенной.
+// Измененный объект удаляется из кэша и перечитывается при следующем Open;
+// при ошибке Stat идет обычным путем
+func (s *s3FS) statCached(name string) (fs.FileInfo, bool) {
+	key := s.key(name)
+	now := time.Now()
+
+	s.cacheMu.Lock()
+	entry := s.cache[key]
+	if entry == nil {
+		s.cacheMu.Unlock()
+		return nil, false
+	}
+	entry.usedAt = now
+	if now.Sub(entry.checkedAt) < s.cacheTTL {
+		s.cacheMu.Unlock()
+		return entry.info(name), true
+	}
+	s.cacheMu.Unlock()
+
+	out, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		IfNoneMatch: aws.String(entry.etag),
+	})
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	if isNotModified(err) {
+		entry.checkedAt = now
+		return entry.info(name), true
+	}
+	if s.cache[key] == entry {
+		delete(s.cache, key)
+	}
+	if err != nil {
+		return nil, false
+	}
+	return s3FileInfo{
+		name:    path.Base(name),
+		size:    aws.ToInt64(out.ContentLength),
+		modTime: aws.ToTime(out.LastModified),
+	}, true
+}
+
+func (s *s3FS) key(name string) string {
+	if name == "." {
+		return s.prefix
+	}
+	return path.Join(s.prefix, name)
+}
+
+func isNotModified(err error) bool {
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified
+}
+
+// Отсутствующие объекты приводятся к fs.ErrNotExist, чтобы обрабатываться как на диске
+func s3Error(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound", "NoSuchBucket":
+			return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+		}
+	}
+	return err
+}
+
+func newS3File(name string, body io.ReadCloser, size int64, modTime time.Time) *s3File {
+	return &s3File{
+		body: body,
+		info: s3FileInfo{
+			name:    path.Base(name),
+			size:    size,
+			modTime: modTime,
+		},
+	}
+}
+
+func (e *s3CacheEntry) info(name string) s3FileInfo {
+	return s3FileInfo{name: path.Base(name), size: int64(len(e.data)), modTime: e.modTime}
+}
+
+func (e *s3CacheEntry) file(name string) *s3File {
+	return newS3File(name, io.NopCloser(bytes.NewReader(e.data)), int64(len(e.data)), e.modTime)
+}
+
+func (b *s3CachingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF && b.store != nil {
+		b.store(b.buf.Bytes())
+		b.store = nil
+	}
+	return n, err
+}
+
+func (b *s3CachingBody) Close() error { return b.body.Close() }
+
+func (f *s3File) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *s3File) Read(p []byte) (int, error) { return f.body.Read(p) }
+func (f *s3File) Close() error               { return f.body.Close() }
+
+func (fi s3FileInfo) Name() string       { return fi.name }
+func (fi s3FileInfo) Size() int64        { return fi.size }
+func (fi s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi s3FileInfo) IsDir() bool        { return fi.dir }
+func (fi s3FileInfo) Sys() any           { return nil }
+
+func (fi s3FileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// S3 с одним объектом; на HeadObject с совпадающим If-None-Match отвечает 304
+type fakeS3 struct {
+	body    string
+	etag    string
+	gets    int
+	heads   []*s3.HeadObjectInput
+	changed bool
+}
+
+func (f *fakeS3) GetObject(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.gets++
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(strings.NewReader(f.body)),
+		ContentLength: aws.Int64(int64(len(f.body))),
+		ETag:          aws.String(f.etag),
+		LastModified:  aws.Time(time.Unix(1700000000, 0)),
+	}, nil
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, params *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.heads = append(f.heads, params)
+	if !f.changed && aws.ToString(params.IfNoneMatch) == f.etag {
+		return nil, &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotModified}},
+		}}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(42),
+		ETag:          aws.String(f.etag + "-new"),
+		LastModified:  aws.Time(time.Unix(1800000000, 0)),
+	}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(_ context.Context, _ *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return &s3.ListObjectsV2Output{}, nil
+}
+
+// Stat закэшированного объекта в пределах TTL не ходит в S3, а после TTL
+// перепроверяет его по ETag и при 304 отдает сведения из кэша
+func TestS3StatUsesCache(t *testing.T) {
+	client := &fakeS3{body: `{"statistic":{}}`, etag: `"v1"`}
+	fsys := &s3FS{client: client, bucket: "reports", prefix: "app", cacheTTL: time.Minute, cache: make(map[string]*s3CacheEntry)}
+
+	if _, err := fsys.ReadFile("widgets/summary.json"); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	info, err := fsys.Stat("widgets/summary.json")
+	if err != nil {
+		t.Fatalf("stat within ttl: %v", err)
+	}
+	if len(client.heads) != 0 {
+		t.Errorf("stat within ttl sent %d HeadObject requests, want none", len(client.heads))
+	}
+	if info.Size() != int64(len(client.body)) || info.Name() != "summary.json" {
+		t.Errorf("stat within ttl = %s, %d bytes", info.Name(), info.Size())
+	}
+
+	// TTL истек: объект перепроверяется по ETag и не скачивается заново
+	fsys.cache["app/widgets/summary.json"].checkedAt = time.Now().Add(-2 * time.Minute)
+	info, err = fsys.Stat("widgets/summary.json")
+	if err != nil {
+		t.Fatalf("stat after ttl: %v", err)
+	}
+	if len(client.heads) != 1 || aws.ToString(client.heads[0].IfNoneMatch) != client.etag {
+		t.Fatalf("stat after ttl sent %d HeadObject requests, want one with If-None-Match %s", len(client.heads), client.etag)
+	}
+	if info.Size() != int64(len(client.body)) {
+		t.Errorf("stat after 304 size = %d, want cached %d", info.Size(), len(client.body))
+	}
+	if _, err := fsys.Stat("widgets/summary.json"); err != nil || len(client.heads) != 1 {
+		t.Errorf("stat after revalidation: err %v, %d HeadObject requests, want 1", err, len(client.heads))
+	}
+
+	// Измененный объект выпадает из кэша, и Open скачивает его снова
+	fsys.cache["app/widgets/summary.json"].checkedAt = time.Now().Add(-2 * time.Minute)
+	client.changed = true
+	info, err = fsys.Stat("widgets/summary.json")
+	if err != nil {
+		t.Fatalf("stat changed object: %v", err)
+	}
+	if info.Size() != 42 {
+		t.Errorf("stat changed object size = %d, want 42", info.Size())
+	}
+	if _, ok := fsys.cache["app/widgets/summary.json"]; ok {
+		t.Error("changed object left in cache")
+	}
+	if client.gets != 1 {
+		t.Errorf("GetObject requests = %d, want 1", client.gets)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Документ /status.json для страниц статуса без Prometheus. Схема стабильна:
+// поля только добавляются, необязательные опускаются, если данных нет
+type (
+	statusDocument struct {
+		GeneratedAt time.Time `json:"generated_at"`
+		// Последний опубликованный снимок любого проекта
+		LastParse           *time.Time      `json:"last_parse,omitempty"`
+		LastParseAgeSeconds *float64        `json:"last_parse_age_seconds,omitempty"`
+		Projects            []projectStatus `json:"projects"`
+	}
+
+	projectStatus struct {
+		Project         string         `json:"project"`
+		ParsedAt        *time.Time     `json:"parsed_at,omitempty"`
+		ParseAgeSeconds *float64       `json:"parse_age_seconds,omitempty"`
+		LastError       string         `json:"last_error,omitempty"`
+		Summary         *statusSummary `json:"summary,omitempty"`
+		FlakyRatio      *float64       `json:"flaky_ratio,omitempty"`
+		Suites          []suiteStatus  `json:"suites"`
+	}
+
+	statusSummary struct {
+		Passed          int     `json:"passed"`
+		Failed          int     `json:"failed"`
+		Broken          int     `json:"broken"`
+		Skipped         int     `json:"skipped"`
+		Total           int     `json:"total"`
+		DurationSeconds float64 `json:"duration_seconds"`
+	}
+
+	suiteStatus struct {
+		Suite    string   `json:"suite"`
+		Total    int      `json:"total"`
+		Passed   int      `json:"passed"`
+		PassRate *float64 `json:"pass_rate,omitempty"`
+	}
+)
+
+// Сводка последнего цикла по всем проектам: те же данные, что и в метриках,
+// одним документом. Без -project и манифеста проект — пустая строка
+func statusJSON(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	doc := statusDocument{GeneratedAt: now, Projects: []projectStatus{}}
+	if last := atomic.LoadInt64(&lastParseTime); last > 0 {
+		parsedAt := time.Unix(0, last)
+		age := now.Sub(parsedAt).Seconds()
+		doc.LastParse, doc.LastParseAgeSeconds = &parsedAt, &age
+	}
+
+	snaps, errs := reportCollector.snapshots(), reportCollector.lastErrors()
+	projects := make(map[string]bool, len(snaps)+len(errs))
+	for project := range snaps {
+		projects[project] = true
+	}
+	for project := range errs {
+		projects[project] = true
+	}
+	names := make([]string, 0, len(projects))
+	for project := range projects {
+		names = append(names, project)
+	}
+	sort.Strings(names)
+
+	for _, project := range names {
+		status := projectStatus{Project: project, LastError: errs[project], Suites: []suiteStatus{}}
+		if snap := snaps[project]; snap != nil {
+			fillProjectStatus(&status, snap, now)
+		}
+		doc.Projects = append(doc.Projects, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(doc); err != nil {
+		logger.Warn("Status write failed", zap.Error(err))
+	}
+}
+
+func fillProjectStatus(status *projectStatus, snap *ReportSnapshot, now time.Time) {
+	parsedAt := snap.ParsedAt
+	age := now.Sub(parsedAt).Seconds()
+	status.ParsedAt, status.ParseAgeSeconds = &parsedAt, &age
+
+	if s := snap.Summary; s != nil {
+		status.Summary = &statusSummary{
+			Passed:          s.Statistic.Passed,
+			Failed:          s.Statistic.Failed,
+			Broken:          s.Statistic.Broken,
+			Skipped:         s.Statistic.Skipped,
+			Total:           s.total(),
+			DurationSeconds: float64(s.Time.Duration) / 1000,
+		}
+	}
+	if snap.History != nil && len(snap.History.Items) > 0 {
+		ratio := flakyRatio(snap.History)
+		status.FlakyRatio = &ratio
+	}
+
+	// Доля passed среди passed, failed и broken, как в allure_feature_pass_ratio;
+	// у сьюта только из пропущенных тестов доли нет
+	for name, suite := range snap.Suites {
+		entry := suiteStatus{Suite: name, Total: suite.Total, Passed: suite.Passed}
+		if ran := suite.Passed + suite.Failed + suite.Broken; ran > 0 {
+			rate := float64(suite.Passed) / float64(ran)
+			entry.PassRate = &rate
+		}
+		status.Suites = append(status.Suites, entry)
+	}
+	sort.Slice(status.Suites, func(i, j int) bool { return status.Suites[i].Suite < status.Suites[j].Suite })
+}
+
+// Разобранный снимок проекта (?project=, по умолчанию единственный отчет) как есть,
+// чтобы интеграционные тесты проверяли значения без разбора формата Prometheus.
+// Включается -snapshot-endpoint: ответ раскрывает содержимое отчета
+func snapshotJSON(w http.ResponseWriter, r *http.Request) {
+	project := r.URL.Query().Get("project")
+	snap := reportCollector.snapshot(project)
+	if snap == nil {
+		http.Error(w, "no snapshot for project "+strconv.Quote(project), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		logger.Warn("Snapshot write failed", zap.Error(err))
+	}
+}
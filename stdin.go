@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Путь "-" вместо директории отчета: тест-кейсы читаются из stdin
+const stdinPath = "-"
+
+// Разбирает JSON-массив тест-кейсов Allure 2 (тот же формат, что и файлы
+// data/test-cases/*.json) и публикует снимок; summary считается по тест-кейсам
+func parseTestCasesReader(r io.Reader) error {
+	if cfg.maxFileSize > 0 {
+		r = io.LimitReader(r, cfg.maxFileSize+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read stdin: %w", err)
+	}
+	if cfg.maxFileSize > 0 && int64(len(data)) > cfg.maxFileSize {
+		return fmt.Errorf("stdin exceeds -max-file-size of %d bytes", cfg.maxFileSize)
+	}
+
+	var testCases []*AllureTestCase
+	if err := json.Unmarshal(data, &testCases); err != nil {
+		return &ErrMalformedJSON{File: "stdin", Err: err}
+	}
+
+	// Массив тест-кейсов версию генератора не содержит
+	snap := &ReportSnapshot{FormatVersion: "unknown", TestCaseFiles: len(testCases)}
+	snap.stage("test_cases", nil)
+	for i, tc := range testCases {
+		if tc == nil {
+			snap.ParseErrors++
+			continue
+		}
+		tc.normalizeStatuses()
+		snap.addTestCase(tc, fmt.Sprintf("stdin[%d]", i))
+	}
+	snap.Summary = summarize(testCases)
+
+	snap.ParsedAt = time.Now()
+	reportCollector.publish(cfg.project, snap)
+	atomic.StoreInt64(&lastParseTime, snap.ParsedAt.UnixNano())
+	countProcessed(snap.Summary)
+
+	logger.Info("Parsing completed",
+		zap.String("source", "stdin"),
+		zap.Int("test_cases", snap.TestCasesFound))
+	return nil
+}
+
+// Один разбор stdin без HTTP-сервера: метрики пишутся в -output или в stdout.
+// С -exit-on-failures stdout занят сводкой проверки, и без -output метрики не пишутся,
+// чтобы сводку (в том числе JSON) можно было разбирать без отделения от метрик
+func runStdin(in io.Reader, stdout io.Writer) {
+	if err := parseTestCasesReader(in); err != nil {
+		logger.Fatal("Failed to parse test cases from stdin", zap.Error(err))
+	}
+
+	var err error
+	switch {
+	case cfg.output != "":
+		err = writeMetricsFile(cfg.output)
+	case cfg.exitOnFailures < 0:
+		err = writeMetrics(stdout)
+	}
+	if err != nil {
+		logger.Fatal("Failed to write metrics", zap.Error(err))
+	}
+}
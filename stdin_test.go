@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const stdinTestCases = `[
+	{"name": "login", "status": "passed", "start": 1700000000000, "stop": 1700000001000},
+	{"name": "logout", "status": "failed", "start": 1700000001000, "stop": 1700000003000}
+]`
+
+// С -exit-on-failures stdout остается за сводкой проверки: метрики туда не пишутся
+func TestRunStdinOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		metrics bool
+	}{
+		{name: "metrics to stdout", args: []string{"-interval", "0"}, metrics: true},
+		{name: "exit on failures", args: []string{"-interval", "0", "-exit-on-failures", "0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, tt.args...)
+			resetCollector(t)
+
+			var stdout bytes.Buffer
+			runStdin(strings.NewReader(stdinTestCases), &stdout)
+			if got := strings.Contains(stdout.String(), "allure_tests_total"); got != tt.metrics {
+				t.Errorf("metrics on stdout = %v, want %v:\n%.500s", got, tt.metrics, stdout.String())
+			}
+			if snap := reportCollector.snapshot(""); snap == nil || snap.TestCasesFound != 2 {
+				t.Errorf("snapshot = %+v, want 2 test cases", snap)
+			}
+		})
+	}
+}
+
+// Сводка -output-format json при чтении из stdin — единственный документ на stdout
+func TestStdinJSONSummary(t *testing.T) {
+	setupConfig(t, "-interval", "0", "-exit-on-failures", "0", "-output-format", "json")
+	resetCollector(t)
+
+	var stdout bytes.Buffer
+	runStdin(strings.NewReader(stdinTestCases), &stdout)
+	code := checkFailures(&stdout)
+	if code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+
+	var doc struct {
+		ExitCode int           `json:"exit_code"`
+		Projects []checkResult `json:"projects"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &doc); err != nil {
+		t.Fatalf("stdout is not a single JSON document: %v\n%.500s", err, stdout.String())
+	}
+	if doc.ExitCode != 1 || len(doc.Projects) != 1 {
+		t.Fatalf("summary = %+v, want exit code 1 and one project", doc)
+	}
+	if p := doc.Projects[0]; p.Verdict != "FAIL" || p.Passed != 1 || p.Failed != 1 {
+		t.Errorf("project = %+v, want FAIL with passed 1, failed 1", p)
+	}
+}